@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/korylprince/printer-manager-cups/control"
+)
+
+// adminMaxBody is the maximum size of an HTTP admin API request body
+const adminMaxBody = 1 << 20
+
+// adminRoute maps an HTTP admin API endpoint to a control handler
+type adminRoute struct {
+	method string
+	packet control.PacketType
+	// body is true if the request body is passed to the handler as the payload
+	body bool
+}
+
+var adminRoutes = map[string]*adminRoute{
+	"/v1/sync":        {http.MethodPost, control.PacketTypeSync, true},
+	"/v1/clear-cache": {http.MethodPost, control.PacketTypeClearCache, false},
+	"/v1/drivers":     {http.MethodGet, control.PacketTypeListDrivers, false},
+	"/v1/status":      {http.MethodGet, control.PacketTypeStatus, false},
+	"/v1/printers":    {http.MethodGet, control.PacketTypeListPrinters, false},
+}
+
+// AdminServer serves the HTTP admin API, running requests with the control Listener's handlers
+type AdminServer struct {
+	con    *control.Listener
+	token  string
+	server *http.Server
+	// Addr is the address the server is listening on
+	Addr string
+}
+
+// NewAdminServer starts serving the HTTP admin API on c.HTTPListen, or returns an error if one occurred
+func NewAdminServer(c *Config, con *control.Listener) (*AdminServer, error) {
+	network, addr := c.httpAddr()
+	var l net.Listener
+	var err error
+	if network == "unix" {
+		opts := c.SocketOptions()
+		opts.Path = addr
+		l, err = control.ListenUnix(addr, opts)
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s: %w", c.HTTPListen, err)
+	}
+
+	s := &AdminServer{con: con, token: c.HTTPToken, Addr: c.HTTPListen}
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("WARN: HTTP admin API stopped:", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Close stops the server, or returns an error if one occurred
+func (s *AdminServer) Close() error {
+	if err := s.server.Close(); err != nil {
+		return fmt.Errorf("Unable to close HTTP server: %w", err)
+	}
+	return nil
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/openapi.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, adminOpenAPI)
+		return
+	}
+
+	route, ok := adminRoutes[r.URL.Path]
+	if !ok {
+		writeAdminError(w, control.Errorf(control.ErrorCodeNotFound, "Unknown endpoint: %s", r.URL.Path))
+		return
+	}
+	if r.Method != route.method {
+		w.Header().Set("Allow", route.method)
+		writeJSON(w, http.StatusMethodNotAllowed, control.Errorf(control.ErrorCodeBadRequest, "Method %s not allowed", r.Method))
+		return
+	}
+
+	if !s.authorized(r) {
+		log.Printf("WARN: Denied HTTP admin API request %s %s from %s: invalid token\n", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="printer-manager"`)
+		writeJSON(w, http.StatusUnauthorized, control.Errorf(control.ErrorCodeForbidden, "Invalid or missing bearer token"))
+		return
+	}
+
+	var payload json.RawMessage
+	if route.body {
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, adminMaxBody))
+		if err != nil {
+			writeAdminError(w, control.Errorf(control.ErrorCodeBadRequest, "Unable to read request: %v", err))
+			return
+		}
+		if buf = bytes.TrimSpace(buf); len(buf) > 0 {
+			if !json.Valid(buf) {
+				writeAdminError(w, control.Errorf(control.ErrorCodeBadRequest, "Request is not valid JSON"))
+				return
+			}
+			payload = buf
+		}
+	}
+
+	log.Printf("INFO: HTTP admin API request %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	resp := s.con.Handle(r.Context(), route.packet, payload)
+	if resp.Error != nil {
+		writeAdminError(w, resp.Error)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp.Payload)
+}
+
+// authorized returns true if r has the correct bearer token
+func (s *AdminServer) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+}
+
+// adminStatus returns the HTTP status code for code
+func adminStatus(code control.ErrorCode) int {
+	switch code {
+	case control.ErrorCodeBadRequest, control.ErrorCodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case control.ErrorCodeForbidden:
+		return http.StatusForbidden
+	case control.ErrorCodeNotFound, control.ErrorCodeUnknownType:
+		return http.StatusNotFound
+	case control.ErrorCodeRateLimited:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// writeAdminError writes err with the matching HTTP status code
+func writeAdminError(w http.ResponseWriter, err *control.Error) {
+	writeJSON(w, adminStatus(err.Code), err)
+}
+
+// writeJSON writes v as JSON with the given HTTP status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, ok := v.(json.RawMessage)
+	if !ok {
+		var err error
+		if buf, err = json.Marshal(v); err != nil {
+			log.Println("WARN: Unable to marshal HTTP response:", err)
+			http.Error(w, "Unable to marshal response", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(buf, '\n'))
+}
+
+// adminOpenAPI is the OpenAPI description of the HTTP admin API
+const adminOpenAPI = `{
+	"openapi": "3.0.3",
+	"info": {
+		"title": "printer-manager admin API",
+		"description": "Manages the printer-manager daemon. All endpoints except this description require a bearer token (HTTPToken).",
+		"version": "1.0.0"
+	},
+	"security": [{"bearerAuth": []}],
+	"paths": {
+		"/v1/sync": {
+			"post": {
+				"summary": "Sync printers for logged in users and, optionally, the given usernames",
+				"operationId": "sync",
+				"requestBody": {
+					"required": false,
+					"content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}
+				},
+				"responses": {
+					"200": {"description": "Sync report", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SyncReport"}}}},
+					"default": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/v1/clear-cache": {
+			"post": {
+				"summary": "Delete all managed printers and clear the cache",
+				"operationId": "clearCache",
+				"responses": {
+					"200": {"description": "Result message", "content": {"application/json": {"schema": {"type": "string"}}}},
+					"default": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/v1/drivers": {
+			"get": {
+				"summary": "List drivers found by CUPS",
+				"operationId": "listDrivers",
+				"responses": {
+					"200": {
+						"description": "Map of driver make and model to PPD name",
+						"content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "string"}}}}
+					},
+					"default": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/v1/status": {
+			"get": {
+				"summary": "Show daemon status",
+				"operationId": "status",
+				"responses": {
+					"200": {"description": "Daemon status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}},
+					"default": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/v1/printers": {
+			"get": {
+				"summary": "List installed and managed printers",
+				"operationId": "listPrinters",
+				"responses": {
+					"200": {
+						"description": "Printers",
+						"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PrinterListing"}}}}
+					},
+					"default": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/v1/openapi.json": {
+			"get": {
+				"summary": "This description",
+				"operationId": "openapi",
+				"security": [],
+				"responses": {"200": {"description": "OpenAPI description", "content": {"application/json": {}}}}
+			}
+		}
+	},
+	"components": {
+		"securitySchemes": {"bearerAuth": {"type": "http", "scheme": "bearer"}},
+		"responses": {
+			"Error": {"description": "Failed request", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+		},
+		"schemas": {
+			"Error": {
+				"type": "object",
+				"properties": {
+					"code": {"type": "string", "enum": ["unknown_type", "unsupported_version", "bad_request", "forbidden", "rate_limited", "not_found", "internal"]},
+					"message": {"type": "string"}
+				}
+			},
+			"Duplicate": {
+				"type": "object",
+				"properties": {
+					"id": {"type": "string"},
+					"device_uri": {"type": "string"},
+					"matched_id": {"type": "string"},
+					"action": {"type": "string", "enum": ["deleted", "disabled", "reported", "protected", "deferred", "failed"]},
+					"error": {"type": "string", "description": "Why the duplicate policy couldn't be applied, if action is failed"}
+				}
+			},
+			"SyncReport": {
+				"type": "object",
+				"properties": {
+					"added": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"failed": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"expired": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"deferred": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"duplicates": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/Duplicate"}},
+					"protected": {"type": "array", "nullable": true, "items": {"type": "string"}}
+				}
+			},
+			"Status": {
+				"type": "object",
+				"description": "Durations are in nanoseconds",
+				"properties": {
+					"version": {"type": "string"},
+					"started": {"type": "string", "format": "date-time"},
+					"uptime": {"type": "integer"},
+					"api_base": {"type": "string"},
+					"cache_backend": {"type": "string"},
+					"cache_path": {"type": "string"},
+					"sync_interval": {"type": "integer"},
+					"duplicate_policy": {"type": "string"},
+					"active_job_policy": {"type": "string"},
+					"syncing": {"type": "boolean"},
+					"last_sync": {"type": "string", "format": "date-time"},
+					"last_duration": {"type": "integer"},
+					"last_result": {"type": "string"},
+					"last_error": {"type": "string"},
+					"next_sync": {"type": "string", "format": "date-time"},
+					"users": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"managed_printers": {"type": "integer"},
+					"cache_size": {"type": "integer"}
+				}
+			},
+			"PrinterListing": {
+				"type": "object",
+				"properties": {
+					"id": {"type": "string"},
+					"name": {"type": "string"},
+					"location": {"type": "string"},
+					"device_uri": {"type": "string"},
+					"driver": {"type": "string"},
+					"managed": {"type": "boolean"},
+					"source": {"type": "string", "enum": ["api", "cache", "local"]},
+					"users": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"expiration": {"type": "string", "format": "date-time", "nullable": true},
+					"state": {"type": "string"},
+					"reasons": {"type": "array", "nullable": true, "items": {"type": "string"}},
+					"default": {"type": "boolean"}
+				}
+			}
+		}
+	}
+}
+`
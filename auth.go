@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	osuser "os/user"
+	"strconv"
+	"strings"
+
+	"github.com/korylprince/printer-manager-cups/control"
+)
+
+// authorize enforces the control command policy: root and members of AdminGroups may run any command,
+// other users may only view status, subscribe to events, and sync their own printers
+func (d *Daemon) authorize(p *control.Packet) error {
+	if p.Peer == nil {
+		if p.Type == control.PacketTypeStatus {
+			return nil
+		}
+		return control.Errorf(control.ErrorCodeForbidden, "Unable to identify client")
+	}
+
+	if p.Peer.UID == 0 {
+		return nil
+	}
+
+	u, err := peerUser(p.Peer)
+	if err != nil {
+		return err
+	}
+
+	admin, err := d.isAdmin(u)
+	if err != nil {
+		return control.Errorf(control.ErrorCodeForbidden, "Unable to look up groups for %s: %v", u.Username, err)
+	}
+	if admin {
+		return nil
+	}
+
+	switch p.Type {
+	case control.PacketTypeStatus, control.PacketTypeSyncUser, control.PacketTypeSubscribe:
+		return nil
+	case control.PacketTypeSync:
+		var users []string
+		if err = p.Decode(&users); err != nil {
+			return control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal users: %v", err)
+		}
+		if len(users) == 1 && (users[0] == u.Username || d.Config().IgnoreUserCase && strings.EqualFold(users[0], u.Username)) {
+			return nil
+		}
+		return control.Errorf(control.ErrorCodeForbidden, "%s may only sync their own printers", u.Username)
+	}
+
+	return control.Errorf(control.ErrorCodeForbidden, "%s is not authorized to run %s", u.Username, p.Type.String())
+}
+
+// peerUser returns the user running peer, or an error if one occurred
+func peerUser(peer *control.Peer) (*osuser.User, error) {
+	if peer == nil {
+		return nil, control.Errorf(control.ErrorCodeForbidden, "Unable to identify client")
+	}
+	u, err := osuser.LookupId(strconv.FormatUint(uint64(peer.UID), 10))
+	if err != nil {
+		return nil, control.Errorf(control.ErrorCodeForbidden, "Unable to look up uid %d: %v", peer.UID, err)
+	}
+	return u, nil
+}
+
+// isAdmin returns true if u is a member of one of the configured AdminGroups, or an error if one occurred
+func (d *Daemon) isAdmin(u *osuser.User) (bool, error) {
+	gids, err := u.GroupIds()
+	if err != nil {
+		return false, fmt.Errorf("Unable to get group ids: %w", err)
+	}
+	// the primary group isn't always included
+	gids = append(gids, u.Gid)
+
+	admins := d.Config().AdminGroups
+	for _, gid := range gids {
+		g, err := osuser.LookupGroupId(gid)
+		if err != nil {
+			// groups without names can't be admin groups
+			continue
+		}
+		for _, name := range admins {
+			if g.Name == name {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
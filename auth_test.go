@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	osuser "os/user"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/korylprince/printer-manager-cups/control"
+)
+
+// testPeer returns the nobody user, its primary group name, and a Peer for it, skipping the test if they can't be found
+func testPeer(t *testing.T) (*osuser.User, string, *control.Peer) {
+	t.Helper()
+	u, err := osuser.Lookup("nobody")
+	if err != nil {
+		t.Skip("nobody user not found:", err)
+	}
+	g, err := osuser.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip("nobody group not found:", err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		t.Skip("invalid nobody uid:", err)
+	}
+	return u, g.Name, &control.Peer{PID: 1, UID: uint32(uid)}
+}
+
+// errorCode returns the control ErrorCode of err, or an empty code if err is nil
+func errorCode(t *testing.T, err error) control.ErrorCode {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	cerr := new(control.Error)
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected control error, got %v", err)
+	}
+	return cerr.Code
+}
+
+func TestAuthorizePacketTypes(t *testing.T) {
+	u, group, peer := testPeer(t)
+
+	all := make(map[control.PacketType]bool)
+	for typ := control.PacketTypeSync; typ <= control.PacketTypeEvent; typ++ {
+		all[typ] = true
+	}
+	ordinary := map[control.PacketType]bool{
+		control.PacketTypeStatus:    true,
+		control.PacketTypeSyncUser:  true,
+		control.PacketTypeSubscribe: true,
+		control.PacketTypeSync:      true,
+	}
+
+	for _, test := range []struct {
+		name    string
+		peer    *control.Peer
+		admins  []string
+		allowed map[control.PacketType]bool
+	}{
+		{"root", &control.Peer{PID: 1, UID: 0}, nil, all},
+		{"admin", peer, []string{"printer-admins", group}, all},
+		{"ordinary", peer, []string{"printer-admins"}, ordinary},
+		{"unidentified", nil, []string{group}, map[control.PacketType]bool{control.PacketTypeStatus: true}},
+		{"unknown uid", &control.Peer{PID: 1, UID: 4000000000}, []string{group}, nil},
+	} {
+		d := NewDaemon("", &Config{AdminGroups: test.admins}, nil, nil)
+		for typ := control.PacketTypeSync; typ <= control.PacketTypeEvent; typ++ {
+			// ordinary users may sync only their own printers
+			payload, _ := json.Marshal([]string{u.Username})
+			err := d.authorize(&control.Packet{Type: typ, Version: control.ProtocolVersion, Payload: payload, Peer: test.peer})
+			if test.allowed[typ] {
+				if err != nil {
+					t.Errorf("%s: expected %s to be allowed, got %v", test.name, typ.String(), err)
+				}
+				continue
+			}
+			if code := errorCode(t, err); code != control.ErrorCodeForbidden {
+				t.Errorf("%s: expected %s to be forbidden, got %v", test.name, typ.String(), err)
+			}
+		}
+	}
+}
+
+func TestAuthorizeSync(t *testing.T) {
+	u, group, peer := testPeer(t)
+
+	for _, test := range []struct {
+		name           string
+		admin          bool
+		ignoreUserCase bool
+		payload        string
+		code           control.ErrorCode
+	}{
+		{"own username", false, false, `["` + u.Username + `"]`, ""},
+		{"other username", false, false, `["someone-else"]`, control.ErrorCodeForbidden},
+		{"own and other usernames", false, false, `["` + u.Username + `", "someone-else"]`, control.ErrorCodeForbidden},
+		{"no usernames", false, false, `[]`, control.ErrorCodeForbidden},
+		{"no payload", false, false, ``, control.ErrorCodeForbidden},
+		{"invalid payload", false, false, `{"users": 1}`, control.ErrorCodeBadRequest},
+		{"own username in other case", false, false, `["` + strings.ToUpper(u.Username) + `"]`, control.ErrorCodeForbidden},
+		{"own username in other case ignoring case", false, true, `["` + strings.ToUpper(u.Username) + `"]`, ""},
+		{"admin other usernames", true, false, `["someone-else", "another"]`, ""},
+		{"admin no usernames", true, false, `[]`, ""},
+	} {
+		config := &Config{AdminGroups: []string{"printer-admins"}, IgnoreUserCase: test.ignoreUserCase}
+		if test.admin {
+			config.AdminGroups = append(config.AdminGroups, group)
+		}
+		d := NewDaemon("", config, nil, nil)
+
+		p := &control.Packet{Type: control.PacketTypeSync, Version: control.ProtocolVersion, Peer: peer}
+		if test.payload != "" {
+			p.Payload = json.RawMessage(test.payload)
+		}
+		if code := errorCode(t, d.authorize(p)); code != test.code {
+			t.Errorf("%s: expected code %q, got %q", test.name, test.code, code)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/y"
+)
+
+//GCInterval is how often the badger value log is garbage collected
+var GCInterval = 10 * time.Minute
+
+//badgerDir is the directory in the cache directory containing the badger database
+const badgerDir = "badger"
+
+//badgerStore is a Store backed by a badger database
+type badgerStore struct {
+	db   *badger.DB
+	lock *os.File
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+//openDB opens, migrates, and verifies the badger database at path
+func openDB(path string) (*badger.DB, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+	if err != nil {
+		err = fmt.Errorf("Unable to open db: %w", err)
+		if badgerCorrupt(err) {
+			return nil, corrupt(err)
+		}
+		return nil, err
+	}
+
+	if err = db.Update(migrateTxn); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to migrate db: %w", err)
+	}
+
+	if err = db.View(func(txn *badger.Txn) error {
+		_, err := readTxn(txn)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to verify db: %w", err)
+	}
+
+	return db, nil
+}
+
+//badgerCorrupt returns true if err opening a badger database was caused by corrupt files.
+//badger doesn't export all of its corruption errors, so some are matched by message
+func badgerCorrupt(err error) bool {
+	if errors.Is(err, badger.ErrTruncateNeeded) || errors.Is(err, y.ErrChecksumMismatch) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "manifest has") || strings.Contains(msg, "corrupted")
+}
+
+//moveLegacyBadger moves badger database files stored directly in the cache directory path into dir
+func moveLegacyBadger(path, dir string) error {
+	if _, err := os.Stat(filepath.Join(path, "MANIFEST")); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read cache directory: %w", err)
+	}
+	if err = os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("Unable to create db directory: %w", err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if name != "MANIFEST" && name != "KEYREGISTRY" && filepath.Ext(name) != ".sst" && filepath.Ext(name) != ".vlog" {
+			continue
+		}
+		if err = os.Rename(filepath.Join(path, name), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("Unable to move %s: %w", name, err)
+		}
+	}
+	log.Println("INFO: Moved badger database to", dir)
+	return nil
+}
+
+//openBadger opens the badger database in the badgerDir subdirectory of the directory path,
+//quarantining it if it's corrupt and repair is true
+func openBadger(path string, repair bool) (Store, string, error) {
+	l, err := lock(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir := filepath.Join(path, badgerDir)
+	if err = moveLegacyBadger(path, dir); err != nil {
+		l.Close()
+		return nil, "", err
+	}
+
+	s := &badgerStore{lock: l, stop: make(chan struct{})}
+	var quarantined string
+
+	s.db, err = openDB(dir)
+	if err != nil {
+		if !repair || !isCorrupt(err) {
+			l.Close()
+			return nil, "", err
+		}
+		if quarantined, err = quarantine(dir, err); err != nil {
+			l.Close()
+			return nil, "", err
+		}
+		if s.db, err = openDB(dir); err != nil {
+			l.Close()
+			return nil, "", fmt.Errorf("Unable to create new db: %w", err)
+		}
+	}
+
+	s.wg.Add(1)
+	go s.gc()
+
+	return s, quarantined, nil
+}
+
+func (s *badgerStore) gc() {
+	defer s.wg.Done()
+	t := time.NewTicker(GCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			var err error
+			for err == nil {
+				err = s.db.RunValueLogGC(0.5)
+			}
+			if !errors.Is(err, badger.ErrNoRewrite) {
+				log.Println("WARN: Unable to garbage collect cache:", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+//Close closes the database, or returns an error if one occurred
+func (s *badgerStore) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+
+	err := s.db.Close()
+	s.lock.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to close db: %w", err)
+	}
+	return nil
+}
+
+//Read returns the Cache, or an error if one occurred
+func (s *badgerStore) Read() (*Cache, error) {
+	var cache *Cache
+	if err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		cache, err = readTxn(txn)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("Unable to read cache: %w", err)
+	}
+	return cache, nil
+}
+
+//Update reads the Cache, calls f with it, and writes the modified Cache in a single transaction.
+//If f returns an error, no changes are written and the error is returned
+func (s *badgerStore) Update(f func(cache *Cache) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		old, err := readTxn(txn)
+		if err != nil {
+			return fmt.Errorf("Unable to read cache: %w", err)
+		}
+
+		cache, err := readTxn(txn)
+		if err != nil {
+			return fmt.Errorf("Unable to read cache: %w", err)
+		}
+
+		if err = f(cache); err != nil {
+			return err
+		}
+
+		if err = writeTxn(txn, old, cache); err != nil {
+			return fmt.Errorf("Unable to write cache: %w", err)
+		}
+		return nil
+	})
+}
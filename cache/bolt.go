@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFile = "cache.db"
+
+var (
+	boltPrinters = []byte("printers")
+	boltUsers    = []byte("users")
+	boltMeta     = []byte("meta")
+	boltVersion  = []byte("version")
+)
+
+//boltStore is a Store backed by a bbolt database
+type boltStore struct {
+	db   *bolt.DB
+	lock *os.File
+}
+
+//openBoltDB opens, initializes, and verifies the bbolt database at path
+func openBoltDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		err = fmt.Errorf("Unable to open db: %w", err)
+		if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+			return nil, corrupt(err)
+		}
+		return nil, err
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltPrinters, boltUsers, boltMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("Unable to create bucket %s: %w", string(name), err)
+			}
+		}
+
+		meta := tx.Bucket(boltMeta)
+		if v := meta.Get(boltVersion); v != nil {
+			version, err := strconv.Atoi(string(v))
+			if err != nil {
+				return corrupt(fmt.Errorf("Unable to parse version: %w", err))
+			}
+			if version > SchemaVersion {
+				return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+			}
+		}
+		if err := meta.Put(boltVersion, []byte(strconv.Itoa(SchemaVersion))); err != nil {
+			return fmt.Errorf("Unable to set version: %w", err)
+		}
+
+		_, err := readBolt(tx)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+//openBolt opens the bbolt database in the directory path, quarantining it if it's corrupt and repair is true
+func openBolt(path string, repair bool) (Store, string, error) {
+	l, err := lock(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := &boltStore{lock: l}
+	file := filepath.Join(path, boltFile)
+	var quarantined string
+
+	s.db, err = openBoltDB(file)
+	if err != nil {
+		if !repair || !isCorrupt(err) {
+			l.Close()
+			return nil, "", err
+		}
+		if quarantined, err = quarantine(file, err); err != nil {
+			l.Close()
+			return nil, "", err
+		}
+		if s.db, err = openBoltDB(file); err != nil {
+			l.Close()
+			return nil, "", fmt.Errorf("Unable to create new db: %w", err)
+		}
+	}
+
+	return s, quarantined, nil
+}
+
+func readBolt(tx *bolt.Tx) (*Cache, error) {
+	cache := New()
+
+	if err := tx.Bucket(boltPrinters).ForEach(func(k, v []byte) error {
+		e := new(Entry)
+		if err := json.Unmarshal(v, e); err != nil {
+			return corrupt(fmt.Errorf("Unable to unmarshal entry: %w", err))
+		}
+		if e.Users == nil {
+			e.Users = make(map[string]time.Time)
+		}
+		cache.Printers[string(k)] = e
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Bucket(boltUsers).ForEach(func(k, v []byte) error {
+		t := new(time.Time)
+		if err := t.UnmarshalBinary(v); err != nil {
+			return corrupt(fmt.Errorf("Unable to unmarshal time: %w", err))
+		}
+		cache.Users[string(k)] = *t
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func writeBolt(tx *bolt.Tx, cache *Cache) error {
+	// recreate buckets to remove deleted keys
+	for _, name := range [][]byte{boltPrinters, boltUsers} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return fmt.Errorf("Unable to delete bucket %s: %w", string(name), err)
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return fmt.Errorf("Unable to create bucket %s: %w", string(name), err)
+		}
+	}
+
+	printers := tx.Bucket(boltPrinters)
+	for id, e := range cache.Printers {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("Unable to marshal entry: %w", err)
+		}
+		if err := printers.Put([]byte(id), buf); err != nil {
+			return fmt.Errorf("Unable to write to cache: %w", err)
+		}
+	}
+
+	users := tx.Bucket(boltUsers)
+	for username, t := range cache.Users {
+		tb, err := t.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("Unable to marshal time: %w", err)
+		}
+		if err := users.Put([]byte(username), tb); err != nil {
+			return fmt.Errorf("Unable to write to cache: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) Read() (*Cache, error) {
+	var cache *Cache
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cache, err = readBolt(tx)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("Unable to read cache: %w", err)
+	}
+	return cache, nil
+}
+
+func (s *boltStore) Update(f func(cache *Cache) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cache, err := readBolt(tx)
+		if err != nil {
+			return fmt.Errorf("Unable to read cache: %w", err)
+		}
+
+		if err = f(cache); err != nil {
+			return err
+		}
+
+		if err = writeBolt(tx, cache); err != nil {
+			return fmt.Errorf("Unable to write cache: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	err := s.db.Close()
+	s.lock.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to close db: %w", err)
+	}
+	return nil
+}
@@ -1,86 +1,169 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/korylprince/printer-manager-cups/cups"
 )
 
-//Cache an expiring value store
-type Cache map[string]time.Time
+var (
+	printerPrefix = []byte("printer/")
+	userPrefix    = []byte("user/")
+)
+
+//Entry is a cached printer
+type Entry struct {
+	Expiration time.Time `json:"expiration"`
+	//Users maps the users that requested the printer to the last time they requested it
+	Users map[string]time.Time `json:"users"`
+	//Printer is the last printer definition received from the API
+	Printer *cups.Printer `json:"printer,omitempty"`
+	//Driver is the driver chosen the last time the printer was added or modified
+	Driver *cups.DriverMatch `json:"driver,omitempty"`
+}
+
+//AddUser records that username requested the printer at time t
+func (e *Entry) AddUser(username string, t time.Time) {
+	if e.Users == nil {
+		e.Users = make(map[string]time.Time)
+	}
+	e.Users[username] = t
+}
+
+//Cache is an expiring store of printers and the users that requested them
+type Cache struct {
+	//Printers maps printer IDs to Entries
+	Printers map[string]*Entry
+	//Users maps usernames to the last time they were seen
+	Users map[string]time.Time
+}
+
+//New returns a new, empty Cache
+func New() *Cache {
+	return &Cache{Printers: make(map[string]*Entry), Users: make(map[string]time.Time)}
+}
+
+//Entry returns the Entry for the given id, creating it if it doesn't exist
+func (cache *Cache) Entry(id string) *Entry {
+	e, ok := cache.Printers[id]
+	if !ok {
+		e = &Entry{Users: make(map[string]time.Time)}
+		cache.Printers[id] = e
+	}
+	return e
+}
 
-//Read returns the Cache from the given path, or an error if one occurred
-func Read(path string) (Cache, error) {
-	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
-	if err != nil {
-		return nil, fmt.Errorf("Unable to open db: %w", err)
+//ExpireUsers removes users not seen since before the given time from the Cache and its Entries.
+//Entries whose users have all been removed are set to expire immediately. The removed usernames are returned
+func (cache *Cache) ExpireUsers(before time.Time) []string {
+	var expired []string
+	for username, seen := range cache.Users {
+		if seen.Before(before) {
+			expired = append(expired, username)
+			delete(cache.Users, username)
+		}
 	}
-	defer db.Close()
 
-	cache := make(Cache)
+	now := time.Now()
+	for _, e := range cache.Printers {
+		if len(e.Users) == 0 {
+			// legacy entries have no users
+			continue
+		}
+		for _, username := range expired {
+			delete(e.Users, username)
+		}
+		if len(e.Users) == 0 && e.Expiration.After(now) {
+			e.Expiration = now
+		}
+	}
+
+	return expired
+}
+
+func printerKey(id string) []byte {
+	return append(append([]byte{}, printerPrefix...), id...)
+}
 
-	if err = db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			if err := item.Value(func(v []byte) error {
+func userKey(username string) []byte {
+	return append(append([]byte{}, userPrefix...), username...)
+}
+
+//readTxn reads the Cache from txn
+func readTxn(txn *badger.Txn) (*Cache, error) {
+	cache := New()
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if err := item.Value(func(v []byte) error {
+			switch {
+			case bytes.HasPrefix(key, printerPrefix):
+				e := new(Entry)
+				if err := json.Unmarshal(v, e); err != nil {
+					return corrupt(fmt.Errorf("Unable to unmarshal entry: %w", err))
+				}
+				if e.Users == nil {
+					e.Users = make(map[string]time.Time)
+				}
+				cache.Printers[string(key[len(printerPrefix):])] = e
+			case bytes.HasPrefix(key, userPrefix):
 				t := new(time.Time)
-				err := t.UnmarshalBinary(v)
-				if err != nil {
-					return fmt.Errorf("Unable to unmarshal time: %w", err)
+				if err := t.UnmarshalBinary(v); err != nil {
+					return corrupt(fmt.Errorf("Unable to unmarshal time: %w", err))
 				}
-				cache[string(item.Key())] = *t
-				return nil
-			}); err != nil {
-				return err
+				cache.Users[string(key[len(userPrefix):])] = *t
 			}
+			return nil
+		}); err != nil {
+			return nil, err
 		}
-		return nil
-	}); err != nil {
-		return nil, fmt.Errorf("Unable to read iterate through database: %w", err)
 	}
 
 	return cache, nil
 }
 
-//Write writes cache to the given path or returns an error if one occurred
-func (cache Cache) Write(path string) error {
-	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
-	if err != nil {
-		return fmt.Errorf("Unable to open db: %w", err)
-	}
-	defer db.Close()
-
-	return db.Update(func(txn *badger.Txn) error {
-		for id, t := range cache {
-			tb, err := t.MarshalBinary()
-			if err != nil {
-				return fmt.Errorf("Unable to marshal time: %w", err)
-			}
-			if err := txn.Set([]byte(id), tb); err != nil {
-				return fmt.Errorf("Unable to write to cache: %w", err)
+//writeTxn writes cache to txn, deleting printers and users in old that aren't in cache
+func writeTxn(txn *badger.Txn, old, cache *Cache) error {
+	for id := range old.Printers {
+		if _, ok := cache.Printers[id]; !ok {
+			if err := txn.Delete(printerKey(id)); err != nil {
+				return fmt.Errorf("Unable to delete key: %w", err)
 			}
 		}
-		return nil
-	})
-}
-
-//Purge removes the given ids from the cache at the given path, or returns an error if one occurred
-func Purge(path string, ids []string) error {
-	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
-	if err != nil {
-		return fmt.Errorf("Unable to open db: %w", err)
 	}
-	defer db.Close()
-
-	return db.Update(func(txn *badger.Txn) error {
-		for _, id := range ids {
-			if err := txn.Delete([]byte(id)); err != nil {
+	for username := range old.Users {
+		if _, ok := cache.Users[username]; !ok {
+			if err := txn.Delete(userKey(username)); err != nil {
 				return fmt.Errorf("Unable to delete key: %w", err)
 			}
 		}
-		return nil
-	})
+	}
+
+	for id, e := range cache.Printers {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("Unable to marshal entry: %w", err)
+		}
+		if err := txn.Set(printerKey(id), buf); err != nil {
+			return fmt.Errorf("Unable to write to cache: %w", err)
+		}
+	}
+	for username, t := range cache.Users {
+		tb, err := t.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("Unable to marshal time: %w", err)
+		}
+		if err := txn.Set(userKey(username), tb); err != nil {
+			return fmt.Errorf("Unable to write to cache: %w", err)
+		}
+	}
+
+	return nil
 }
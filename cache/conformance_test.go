@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//checkConformance verifies that Stores returned by open follow the Store contract.
+//open must return a Store backed by the same, initially empty storage each time it's called
+func checkConformance(t *testing.T, open func() (Store, error)) {
+	s, err := open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			s.Close()
+		}
+	}()
+
+	c, err := s.Read()
+	if err != nil {
+		t.Fatalf("read empty: %v", err)
+	}
+	if len(c.Printers) != 0 || len(c.Users) != 0 {
+		t.Fatal("read empty: cache is not empty")
+	}
+
+	if _, err = open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("open while open: expected ErrLocked, got %v", err)
+	}
+
+	now := time.Now().Round(0)
+	if err = s.Update(func(c *Cache) error {
+		c.Entry("printer1").AddUser("user1", now)
+		c.Entry("printer1").Expiration = now
+		c.Entry("printer2").Expiration = now
+		c.Users["user1"] = now
+		return nil
+	}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	errAbort := errors.New("abort")
+	if err = s.Update(func(c *Cache) error {
+		delete(c.Printers, "printer1")
+		return errAbort
+	}); !errors.Is(err, errAbort) {
+		t.Fatalf("aborted update: expected error, got %v", err)
+	}
+
+	if err = s.Update(func(c *Cache) error {
+		delete(c.Printers, "printer2")
+		return nil
+	}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	closed = true
+	if err = s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if s, err = open(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	if c, err = s.Read(); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	e, ok := c.Printers["printer1"]
+	switch {
+	case !ok:
+		t.Fatal("read: printer1 missing after aborted update")
+	case len(c.Printers) != 1:
+		t.Fatalf("read: expected 1 printer, got %d", len(c.Printers))
+	case !e.Expiration.Equal(now):
+		t.Fatalf("read: expected expiration %v, got %v", now, e.Expiration)
+	case !e.Users["user1"].Equal(now):
+		t.Fatalf("read: expected user1 in printer1, got %v", e.Users)
+	case !c.Users["user1"].Equal(now):
+		t.Fatalf("read: expected user1 last seen %v, got %v", now, c.Users["user1"])
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, backend := range []string{BackendBadger, BackendBolt, BackendJSON} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			checkConformance(t, func() (Store, error) {
+				s, quarantined, err := Open(backend, dir)
+				if quarantined != "" {
+					t.Fatalf("open: unexpectedly quarantined to %s", quarantined)
+				}
+				return s, err
+			})
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+//ExportVersion is the current version of the Export format
+const ExportVersion = 1
+
+//Export is a portable representation of a Cache
+type Export struct {
+	Version  int                  `json:"version"`
+	Exported time.Time            `json:"exported"`
+	Printers map[string]*Entry    `json:"printers"`
+	Users    map[string]time.Time `json:"users"`
+}
+
+//Export returns an Export of the Cache
+func (cache *Cache) Export() *Export {
+	return &Export{
+		Version:  ExportVersion,
+		Exported: time.Now(),
+		Printers: cache.Printers,
+		Users:    cache.Users,
+	}
+}
+
+//Import merges the Export into the Cache, keeping the latest expiration and user times,
+//or returns an error if the Export is invalid. The IDs of the imported printers are returned
+func (cache *Cache) Import(e *Export) ([]string, error) {
+	if e.Version < 1 || e.Version > ExportVersion {
+		return nil, fmt.Errorf("Unsupported export version: %d", e.Version)
+	}
+
+	for username, t := range e.Users {
+		if t.After(cache.Users[username]) {
+			cache.Users[username] = t
+		}
+	}
+
+	ids := make([]string, 0, len(e.Printers))
+	for id, imported := range e.Printers {
+		if id == "" || imported == nil {
+			return nil, fmt.Errorf("Invalid printer entry: %q", id)
+		}
+		if imported.Printer != nil && imported.Printer.ID != id {
+			return nil, fmt.Errorf("Printer ID %q does not match entry %q", imported.Printer.ID, id)
+		}
+		entry := cache.Entry(id)
+		if imported.Expiration.After(entry.Expiration) {
+			entry.Expiration = imported.Expiration
+		}
+		for username, t := range imported.Users {
+			if t.After(entry.Users[username]) {
+				entry.AddUser(username, t)
+			}
+		}
+		if entry.Printer == nil {
+			entry.Printer = imported.Printer
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
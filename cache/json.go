@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const jsonFile = "cache.json"
+
+type jsonDocument struct {
+	Version  int                  `json:"version"`
+	Printers map[string]*Entry    `json:"printers"`
+	Users    map[string]time.Time `json:"users"`
+}
+
+//jsonStore is a Store backed by a JSON file that is atomically replaced on every write
+type jsonStore struct {
+	path string
+	lock *os.File
+	mu   sync.Mutex
+}
+
+//openJSON opens the JSON file in the directory path, quarantining it if it's corrupt and repair is true
+func openJSON(path string, repair bool) (Store, string, error) {
+	l, err := lock(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := &jsonStore{path: filepath.Join(path, jsonFile), lock: l}
+	var quarantined string
+
+	if _, err = s.Read(); err != nil {
+		if !repair || !isCorrupt(err) {
+			l.Close()
+			return nil, "", err
+		}
+		if quarantined, err = quarantine(s.path, err); err != nil {
+			l.Close()
+			return nil, "", err
+		}
+	}
+
+	return s, quarantined, nil
+}
+
+func (s *jsonStore) Read() (*Cache, error) {
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return New(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read cache: %w", err)
+	}
+
+	doc := new(jsonDocument)
+	if err = json.Unmarshal(buf, doc); err != nil {
+		return nil, corrupt(fmt.Errorf("Unable to unmarshal cache: %w", err))
+	}
+
+	if doc.Version > SchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, doc.Version)
+	}
+
+	cache := New()
+	for id, e := range doc.Printers {
+		if e.Users == nil {
+			e.Users = make(map[string]time.Time)
+		}
+		cache.Printers[id] = e
+	}
+	for username, t := range doc.Users {
+		cache.Users[username] = t
+	}
+
+	return cache, nil
+}
+
+//write atomically replaces the JSON file with cache
+func (s *jsonStore) write(cache *Cache) error {
+	buf, err := json.MarshalIndent(&jsonDocument{Version: SchemaVersion, Printers: cache.Printers, Users: cache.Users}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal cache: %w", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), jsonFile+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary file: %w", err)
+	}
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("Unable to write temporary file: %w", err)
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("Unable to sync temporary file: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Unable to close temporary file: %w", err)
+	}
+
+	if err = os.Rename(f.Name(), s.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Unable to replace cache: %w", err)
+	}
+
+	return nil
+}
+
+func (s *jsonStore) Update(f func(cache *Cache) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cache, err := s.Read()
+	if err != nil {
+		return err
+	}
+
+	if err = f(cache); err != nil {
+		return err
+	}
+
+	return s.write(cache)
+}
+
+func (s *jsonStore) Close() error {
+	return s.lock.Close()
+}
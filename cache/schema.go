@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+//SchemaVersion is the current version of the database schema
+const SchemaVersion = 2
+
+//ErrUnsupportedVersion is returned when the database was written by a newer version
+var ErrUnsupportedVersion = errors.New("unsupported schema version")
+
+var (
+	metaPrefix = []byte("meta/")
+	versionKey = []byte("meta/version")
+)
+
+//migrations[i] migrates the database from version i+1 to i+2
+var migrations = []func(txn *badger.Txn) error{
+	migrateV1,
+}
+
+//getVersion returns the schema version of the database. Databases without a version key are version 1
+func getVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(versionKey)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 1, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Unable to get version: %w", err)
+	}
+
+	var version int
+	if err = item.Value(func(v []byte) error {
+		version, err = strconv.Atoi(string(v))
+		return err
+	}); err != nil {
+		return 0, corrupt(fmt.Errorf("Unable to parse version: %w", err))
+	}
+
+	return version, nil
+}
+
+//migrateTxn migrates the database to SchemaVersion
+func migrateTxn(txn *badger.Txn) error {
+	version, err := getVersion(txn)
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	for ; version < SchemaVersion; version++ {
+		if err = migrations[version-1](txn); err != nil {
+			return fmt.Errorf("Unable to migrate from version %d: %w", version, err)
+		}
+	}
+
+	if err = txn.Set(versionKey, []byte(strconv.Itoa(SchemaVersion))); err != nil {
+		return fmt.Errorf("Unable to set version: %w", err)
+	}
+
+	return nil
+}
+
+//migrateV1 converts legacy (id -> binary time) keys to Entries
+func migrateV1(txn *badger.Txn) error {
+	type legacy struct{ key, value []byte }
+	var entries []legacy
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if bytes.HasPrefix(key, printerPrefix) || bytes.HasPrefix(key, userPrefix) || bytes.HasPrefix(key, metaPrefix) {
+			continue
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return fmt.Errorf("Unable to read value: %w", err)
+		}
+		entries = append(entries, legacy{key: item.KeyCopy(nil), value: v})
+	}
+	it.Close()
+
+	for _, l := range entries {
+		t := new(time.Time)
+		if err := t.UnmarshalBinary(l.value); err != nil {
+			return corrupt(fmt.Errorf("Unable to unmarshal time for %s: %w", string(l.key), err))
+		}
+
+		buf, err := json.Marshal(&Entry{Expiration: *t, Users: make(map[string]time.Time)})
+		if err != nil {
+			return fmt.Errorf("Unable to marshal entry: %w", err)
+		}
+
+		if err = txn.Set(printerKey(string(l.key)), buf); err != nil {
+			return fmt.Errorf("Unable to write entry: %w", err)
+		}
+		if err = txn.Delete(l.key); err != nil {
+			return fmt.Errorf("Unable to delete legacy key: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//Backends
+const (
+	BackendBadger = "badger"
+	BackendJSON   = "json"
+	BackendBolt   = "bolt"
+)
+
+//ErrLocked is returned when the cache is already opened by another process
+var ErrLocked = errors.New("cache is in use by another process")
+
+//ErrCorrupt is matched by errors caused by corrupt storage
+var ErrCorrupt = errors.New("cache is corrupt")
+
+//corruptError is an error caused by corrupt storage
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *corruptError) Unwrap() error {
+	return e.err
+}
+
+func (e *corruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+//corrupt marks err as caused by corrupt storage
+func corrupt(err error) error {
+	return &corruptError{err: err}
+}
+
+const lockFile = "printer-manager.lock"
+
+//Store is a long-lived handle to persistent Cache storage
+type Store interface {
+	//Read returns the Cache, or an error if one occurred
+	Read() (*Cache, error)
+	//Update reads the Cache, calls f with it, and writes the modified Cache atomically.
+	//If f returns an error, no changes are written and the error is returned
+	Update(f func(cache *Cache) error) error
+	//Close closes the Store, or returns an error if one occurred
+	Close() error
+}
+
+//Open opens the Store for backend in the directory path, or returns an error if one occurred.
+//ErrLocked is returned if another process has the cache open.
+//If the existing storage is corrupt, it's moved aside, new storage is created, and the quarantine path is returned
+func Open(backend, path string) (store Store, quarantined string, err error) {
+	return open(backend, path, true)
+}
+
+//open opens the Store for backend in the directory path, quarantining corrupt storage if repair is true
+func open(backend, path string, repair bool) (Store, string, error) {
+	switch backend {
+	case BackendBadger:
+		return openBadger(path, repair)
+	case BackendJSON:
+		return openJSON(path, repair)
+	case BackendBolt:
+		return openBolt(path, repair)
+	}
+	return nil, "", fmt.Errorf("Unknown cache backend: %s", backend)
+}
+
+//Migrate replaces the contents of the to backend's Store in the directory path with the contents of the from backend's Store,
+//or returns an error if one occurred. A corrupt from Store is left in place and an error is returned
+func Migrate(path, from, to string) error {
+	if from == to {
+		return errors.New("Backends must be different")
+	}
+
+	src, _, err := open(from, path, false)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s cache: %w", from, err)
+	}
+
+	// both backends share the directory lock, so src must be closed first
+	cache, err := src.Read()
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to read %s cache: %w", from, err)
+	}
+
+	dst, _, err := Open(to, path)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s cache: %w", to, err)
+	}
+	defer dst.Close()
+
+	return dst.Update(func(c *Cache) error {
+		*c = *cache
+		return nil
+	})
+}
+
+//lock creates the directory path and acquires an exclusive lock on it
+func lock(path string) (*os.File, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create cache directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(path, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file: %w", err)
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("Unable to lock cache: %w", err)
+	}
+
+	return f, nil
+}
+
+//isCorrupt returns true if err opening storage was caused by corruption, and the storage should be quarantined.
+//Other errors, e.g. permission or I/O errors, leave the storage in place
+func isCorrupt(err error) bool {
+	return errors.Is(err, ErrCorrupt) && !errors.Is(err, os.ErrPermission)
+}
+
+//quarantine moves the corrupt file or directory at path aside, returning the new path or an error if one occurred
+func quarantine(path string, cause error) (string, error) {
+	quarantined := fmt.Sprintf("%s.corrupt-%s", filepath.Clean(path), time.Now().Format("20060102150405"))
+	log.Printf("WARN: Cache database is corrupt, moving to %s: %v\n", quarantined, cause)
+	if err := os.Rename(path, quarantined); err != nil {
+		return "", fmt.Errorf("Unable to quarantine corrupt db: %w", err)
+	}
+	return quarantined, nil
+}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+func TestIsCorrupt(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		corrupt bool
+	}{
+		{corrupt(errors.New("bad json")), true},
+		{fmt.Errorf("Unable to read: %w", corrupt(errors.New("bad json"))), true},
+		{fmt.Errorf("Unable to open db: %w", os.ErrPermission), false},
+		{corrupt(fmt.Errorf("Unable to open db: %w", os.ErrPermission)), false},
+		{fmt.Errorf("Unable to write: %w", errors.New("no space left on device")), false},
+		{ErrLocked, false},
+		{fmt.Errorf("%w: %d", ErrUnsupportedVersion, 3), false},
+	} {
+		if c := isCorrupt(test.err); c != test.corrupt {
+			t.Errorf("isCorrupt(%v): expected %v, got %v", test.err, test.corrupt, c)
+		}
+	}
+}
+
+func TestOpenQuarantinesCorruptJSON(t *testing.T) {
+	dir := t.TempDir()
+	other := filepath.Join(dir, "ppds")
+	if err := os.Mkdir(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, jsonFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, quarantined, err := Open(BackendJSON, dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	if quarantined == "" {
+		t.Fatal("expected corrupt cache to be quarantined")
+	}
+	if _, err = os.Stat(quarantined); err != nil {
+		t.Errorf("quarantined file missing: %v", err)
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("unrelated directory was moved: %v", err)
+	}
+}
+
+func TestOpenKeepsUnreadableJSON(t *testing.T) {
+	dir := t.TempDir()
+	// a directory in place of the cache file causes an I/O error, not corruption
+	if err := os.Mkdir(filepath.Join(dir, jsonFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, quarantined, err := Open(BackendJSON, dir); err == nil || quarantined != "" {
+		t.Fatalf("expected error without quarantine, got %v (quarantined %q)", err, quarantined)
+	}
+}
+
+func TestOpenQuarantinesOnlyBadgerDir(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := Open(BackendBadger, dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	other := filepath.Join(dir, "ppds")
+	if err = os.Mkdir(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, badgerDir, "MANIFEST"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, quarantined, err := Open(BackendBadger, dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	if quarantined == "" || filepath.Dir(quarantined) != dir {
+		t.Fatalf("expected %s to be quarantined in %s, got %q", badgerDir, dir, quarantined)
+	}
+	for _, path := range []string{other, filepath.Join(dir, lockFile)} {
+		if _, err = os.Stat(path); err != nil {
+			t.Errorf("%s was moved: %v", path, err)
+		}
+	}
+}
+
+func TestOpenMigratesLegacyBadger(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Round(0)
+	legacy := map[string]time.Time{
+		"printer1": now,
+		"printer2": now.Add(-time.Hour),
+	}
+
+	// version 1 databases were stored in the cache directory with printer ID -> binary time keys and no version key
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("open legacy db: %v", err)
+	}
+	if err = db.Update(func(txn *badger.Txn) error {
+		for id, exp := range legacy {
+			buf, err := exp.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err = txn.Set([]byte(id), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("write legacy db: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("close legacy db: %v", err)
+	}
+
+	s, quarantined, err := Open(BackendBadger, dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if quarantined != "" {
+		t.Fatalf("unexpectedly quarantined to %s", quarantined)
+	}
+
+	c, err := s.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(c.Printers) != len(legacy) {
+		t.Errorf("expected %d printers, got %v", len(legacy), c.Printers)
+	}
+	for id, exp := range legacy {
+		e, ok := c.Printers[id]
+		if !ok {
+			t.Errorf("expected %s to be migrated", id)
+			continue
+		}
+		if !e.Expiration.Equal(exp) {
+			t.Errorf("%s: expected expiration %v, got %v", id, exp, e.Expiration)
+		}
+		if e.Printer != nil || len(e.Users) != 0 {
+			t.Errorf("%s: expected no printer or users, got %v, %v", id, e.Printer, e.Users)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "MANIFEST")); !os.IsNotExist(err) {
+		t.Errorf("expected MANIFEST to be moved, got %v", err)
+	}
+
+	// the legacy keys are replaced and the version is recorded
+	db, err = openDB(filepath.Join(dir, badgerDir))
+	if err != nil {
+		t.Fatalf("open migrated db: %v", err)
+	}
+	defer db.Close()
+	if err = db.View(func(txn *badger.Txn) error {
+		for id := range legacy {
+			if _, err := txn.Get([]byte(id)); !errors.Is(err, badger.ErrKeyNotFound) {
+				t.Errorf("expected legacy key %s to be deleted, got %v", id, err)
+			}
+		}
+		version, err := getVersion(txn)
+		if err != nil {
+			return err
+		}
+		if version != SchemaVersion {
+			t.Errorf("expected version %d, got %d", SchemaVersion, version)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("view migrated db: %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := Open(BackendJSON, dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	now := time.Now().Round(0)
+	if err = s.Update(func(c *Cache) error {
+		c.Entry("printer1").AddUser("user1", now)
+		return nil
+	}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if err = Migrate(dir, BackendJSON, BackendJSON); err == nil {
+		t.Error("expected error migrating to the same backend")
+	}
+
+	for _, m := range [][2]string{{BackendJSON, BackendBolt}, {BackendBolt, BackendBadger}} {
+		if err = Migrate(dir, m[0], m[1]); err != nil {
+			t.Fatalf("migrate %s to %s: %v", m[0], m[1], err)
+		}
+	}
+
+	s, _, err = Open(BackendBadger, dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	c, err := s.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if e, ok := c.Printers["printer1"]; !ok || !e.Users["user1"].Equal(now) {
+		t.Fatalf("expected printer1 to be migrated, got %v", c.Printers)
+	}
+}
+
+func TestMigrateKeepsCorruptSource(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, jsonFile)
+	if err := ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(dir, BackendJSON, BackendBolt); err == nil {
+		t.Fatal("expected error migrating corrupt cache")
+	}
+	if buf, err := ioutil.ReadFile(file); err != nil || string(buf) != "{" {
+		t.Fatalf("expected corrupt cache to be left in place, got %q, %v", buf, err)
+	}
+}
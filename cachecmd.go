@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korylprince/printer-manager-cups/cache"
+	"github.com/korylprince/printer-manager-cups/cups"
+	"github.com/korylprince/printer-manager-cups/httpapi"
+	"github.com/korylprince/printer-manager-cups/progress"
+)
+
+// Why returns a description of why the printer with the given id is installed or an error if one occurred
+func Why(store cache.Store, id string) (string, error) {
+	pCache, err := store.Read()
+	if err != nil {
+		return "", fmt.Errorf("Unable to read cache: %w", err)
+	}
+
+	e, ok := pCache.Printers[id]
+	if !ok {
+		return fmt.Sprintf("%s is not managed by printer-manager", id), nil
+	}
+
+	s := fmt.Sprintf("%s expires %s", id, e.Expiration.Format(time.RFC3339))
+	if len(e.Users) == 0 {
+		s += "\nNo users recorded"
+	} else {
+		usernames := make([]string, 0, len(e.Users))
+		for u := range e.Users {
+			usernames = append(usernames, u)
+		}
+		sort.Strings(usernames)
+
+		s += "\nRequested by:"
+		for _, u := range usernames {
+			s += fmt.Sprintf("\n\t%s (last requested %s, last seen %s)", u, e.Users[u].Format(time.RFC3339), pCache.Users[u].Format(time.RFC3339))
+		}
+	}
+	if e.Driver != nil {
+		s += fmt.Sprintf("\nDriver: %s", e.Driver)
+	}
+	return s, nil
+}
+
+// CacheList returns a table of cache entries or an error if one occurred
+func CacheList(store cache.Store) (string, error) {
+	pCache, err := store.Read()
+	if err != nil {
+		return "", fmt.Errorf("Unable to read cache: %w", err)
+	}
+
+	ids := make([]string, 0, len(pCache.Printers))
+	for id := range pCache.Printers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEXPIRES\tUSERS")
+	for _, id := range ids {
+		e := pCache.Printers[id]
+		usernames := make([]string, 0, len(e.Users))
+		for u := range e.Users {
+			usernames = append(usernames, u)
+		}
+		sort.Strings(usernames)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", id, e.Expiration.Format(time.RFC3339), strings.Join(usernames, ","))
+	}
+	if err = w.Flush(); err != nil {
+		return "", fmt.Errorf("Unable to write table: %w", err)
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// CacheExtend adds d (which may be negative) to the expiration of the cache entry with the given id or returns an error if one occurred
+func CacheExtend(store cache.Store, id string, d time.Duration) (string, error) {
+	var expiration time.Time
+	if err := store.Update(func(c *cache.Cache) error {
+		e, ok := c.Printers[id]
+		if !ok {
+			return fmt.Errorf("%s is not managed by printer-manager", id)
+		}
+		e.Expiration = e.Expiration.Add(d)
+		expiration = e.Expiration
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	log.Printf("INFO: Set expiration of %s to %s\n", id, expiration.Format(time.RFC3339))
+	return fmt.Sprintf("%s now expires %s", id, expiration.Format(time.RFC3339)), nil
+}
+
+// CacheEvict deletes the printer with the given id from CUPS and removes it from the cache or returns an error if one occurred
+func CacheEvict(ctx context.Context, config *Config, client *cups.Client, store cache.Store, id string) (string, error) {
+	pCache, err := store.Read()
+	if err != nil {
+		return "", fmt.Errorf("Unable to read cache: %w", err)
+	}
+
+	if _, ok := pCache.Printers[id]; !ok {
+		return "", fmt.Errorf("%s is not managed by printer-manager", id)
+	}
+
+	cupsPrinters, err := client.GetPrinters()
+	if err != nil {
+		if !strings.Contains(err.Error(), "No destinations added.") {
+			return "", fmt.Errorf("Unable to get CUPS printers: %w", err)
+		}
+	}
+
+	for _, cp := range cupsPrinters {
+		if cp.ID != id {
+			continue
+		}
+		if config.IsProtected(cp) {
+			return "", fmt.Errorf("%s is protected", id)
+		}
+		deferred, err := deletePrinter(ctx, config, client, cp)
+		if err != nil {
+			return "", fmt.Errorf("Unable to delete printer: %w", err)
+		}
+		if deferred {
+			// expire now so the next sync deletes it
+			if err = store.Update(func(c *cache.Cache) error {
+				if e, ok := c.Printers[id]; ok {
+					e.Expiration = time.Now()
+				}
+				return nil
+			}); err != nil {
+				return "", fmt.Errorf("Unable to update cache: %w", err)
+			}
+			log.Printf("INFO: Deferred evicting printer %s (%s) with active jobs\n", cp.ID, cp.Hostname)
+			return fmt.Sprintf("%s has active jobs and will be deleted on the next sync", id), nil
+		}
+		log.Printf("INFO: Deleted evicted printer %s (%s)\n", cp.ID, cp.Hostname)
+		break
+	}
+
+	if err = purge(store, []string{id}); err != nil {
+		return "", fmt.Errorf("Unable to purge cache: %w", err)
+	}
+
+	return fmt.Sprintf("%s evicted", id), nil
+}
+
+// CacheExport returns a JSON export of the cache or an error if one occurred
+func CacheExport(store cache.Store) (string, error) {
+	pCache, err := store.Read()
+	if err != nil {
+		return "", fmt.Errorf("Unable to read cache: %w", err)
+	}
+
+	buf, err := json.MarshalIndent(pCache.Export(), "", "\t")
+	if err != nil {
+		return "", fmt.Errorf("Unable to marshal export: %w", err)
+	}
+
+	return string(buf), nil
+}
+
+// CacheImport merges the JSON export into the cache and installs the imported printers or returns an error if one occurred
+func CacheImport(ctx context.Context, config *Config, client *cups.Client, store cache.Store, export string) (string, error) {
+	e := new(cache.Export)
+	if err := json.Unmarshal([]byte(export), e); err != nil {
+		return "", fmt.Errorf("Unable to unmarshal export: %w", err)
+	}
+
+	cupsPrinters := installedPrinters(client, store)
+
+	var pCache *cache.Cache
+	var ids []string
+	if err := store.Update(func(c *cache.Cache) error {
+		var err error
+		if ids, err = c.Import(e); err != nil {
+			return err
+		}
+		pCache = c
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("Unable to import cache: %w", err)
+	}
+
+	log.Println("INFO: Imported", len(ids), "printers into cache")
+
+	var installed, failed, protected []string
+	drivers := make(map[string]*cups.DriverMatch)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		entry := pCache.Printers[id]
+		if entry.Printer == nil || entry.Expiration.Before(time.Now()) {
+			continue
+		}
+		if i := cupsPrinters[id]; i.isProtected(config) {
+			log.Printf("INFO: Skipped modifying protected printer %s (%s)\n", id, i.DeviceURI)
+			progress.Report(ctx, "Skipped protected printer %s", id)
+			protected = append(protected, id)
+			continue
+		}
+		driver, err := client.AddOrModify(ctx, entry.Printer)
+		if err != nil {
+			log.Printf("WARN: Unable to add or modify imported printer %s (%s): %v\n", id, entry.Printer.Hostname, err)
+			progress.Report(ctx, "Failed to add or modify imported printer %s: %v", id, err)
+			failed = append(failed, id)
+			continue
+		}
+		log.Printf("INFO: Added/Modified imported printer: %s (%s) using driver %s\n", id, entry.Printer.Hostname, driver)
+		progress.Report(ctx, "Added/Modified imported printer %s", id)
+		installed = append(installed, id)
+		drivers[id] = driver
+	}
+	recordDrivers(store, drivers)
+
+	s := fmt.Sprintf("Imported %d printers, installed %d", len(ids), len(installed))
+	if len(failed) > 0 {
+		s += fmt.Sprintf("\nFailed: %s", strings.Join(failed, ", "))
+	}
+	if len(protected) > 0 {
+		s += fmt.Sprintf("\nProtected: %s", strings.Join(protected, ", "))
+	}
+	return s, nil
+}
+
+// RecoverCache rebuilds the cache from the CUPS printers the API returns for the logged in users, or returns an error if one occurred.
+// Other CUPS printers aren't adopted, since they may have been created by users
+func RecoverCache(ctx context.Context, config *Config, client *cups.Client, store cache.Store) error {
+	users, err := activeUsers(config, nil)
+	if err != nil {
+		return err
+	}
+
+	printers, printerUsers, err := httpapi.GetPrinters(ctx, config.APIBase, users)
+	if err != nil {
+		return fmt.Errorf("Unable to get API printers: %w", err)
+	}
+	api := make(map[string]*cups.Printer, len(printers))
+	for _, p := range printers {
+		api[p.ID] = p
+	}
+
+	cupsPrinters, err := client.GetPrinters()
+	if err != nil {
+		if !strings.Contains(err.Error(), "No destinations added.") {
+			return fmt.Errorf("Unable to get CUPS printers: %w", err)
+		}
+	}
+
+	var recovered []string
+	if err = store.Update(func(c *cache.Cache) error {
+		now := time.Now()
+		for _, cp := range cupsPrinters {
+			p, ok := api[cp.ID]
+			if !ok || config.IsProtected(cp) {
+				continue
+			}
+			e := c.Entry(cp.ID)
+			e.Expiration = now.Add(config.CacheTime)
+			e.Printer = p
+			for _, u := range printerUsers[cp.ID] {
+				e.AddUser(u, now)
+				c.Users[u] = now
+			}
+			recovered = append(recovered, cp.ID)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("Unable to update cache: %w", err)
+	}
+
+	log.Printf("INFO: Rebuilt cache with %d printers from CUPS: %s\n", len(recovered), strings.Join(recovered, ", "))
+	return nil
+}
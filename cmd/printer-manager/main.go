@@ -1,58 +1,349 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/korylprince/printer-manager-cups/control"
 )
 
-func DoCommand(pkt *control.Packet) {
-	resp, err := control.Do(pkt)
+// Version is the client version, set at build time with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+var client *control.Client
+var legacy bool
+
+// quiet disables streaming progress
+var quiet bool
+
+// socket is the control socket path, set with --socket or the SOCKETPATH environment variable
+var socket = os.Getenv(control.SocketEnv)
+
+// socketPath returns the control socket path, exiting if none can be found
+func socketPath() string {
+	if socket != "" {
+		return socket
+	}
+	sock, err := control.GetSocket()
 	if err != nil {
-		if strings.Contains(err.Error(), "connect: no such file or directory") {
-			fmt.Println("Control socket not found. Are you sure the server is running?")
-		} else {
-			fmt.Println("Unable to send command to server:", err)
+		fmt.Println("Unable to find control socket:", err)
+		os.Exit(1)
+	}
+	return sock
+}
+
+// dialError prints a description of err from connecting to sock and exits
+func dialError(sock string, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ECONNREFUSED):
+		fmt.Printf("Control socket %s not found. Are you sure the server is running?\n", sock)
+		fmt.Printf("If the server uses a different SocketPath, set it with --socket or %s\n", control.SocketEnv)
+	case errors.Is(err, os.ErrPermission):
+		fmt.Printf("Permission denied for control socket %s. Check the server's SocketGroup and SocketMode\n", sock)
+	default:
+		fmt.Println("Unable to send command to server:", err)
+	}
+	os.Exit(1)
+}
+
+// connect connects to the server, falling back to the legacy protocol for older servers, and exits if an error occurred
+func connect() {
+	if client != nil || legacy {
+		return
+	}
+	sock := socketPath()
+	c, err := control.Dial(sock, Version)
+	if err == control.ErrLegacyServer {
+		fmt.Fprintln(os.Stderr, "WARN: Server only supports the legacy control protocol; upgrade the server to match client version", Version)
+		legacy = true
+		return
+	}
+	if err != nil {
+		dialError(sock, err)
+	}
+	if c.ServerVersion != Version {
+		fmt.Fprintf(os.Stderr, "WARN: Server version (%s) differs from client version (%s)\n", c.ServerVersion, Version)
+	}
+	if !quiet {
+		c.Progress = func(msg string) {
+			fmt.Println("...", msg)
 		}
+	}
+	client = c
+}
+
+// legacyMessage returns req encoded as a legacy packet message
+func legacyMessage(req interface{}) string {
+	switch r := req.(type) {
+	case nil:
+		return ""
+	case string:
+		return r
+	case json.RawMessage:
+		return string(r)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		fmt.Println("Unable to marshal request:", err)
 		os.Exit(1)
 	}
+	return string(b)
+}
+
+// Send sends a request of type t with payload req to the server and returns the response, exiting if an error occurred
+func Send(t control.PacketType, req interface{}) *control.Packet {
+	connect()
+	var resp *control.Packet
+	var err error
+	if legacy {
+		resp, err = control.Do(socketPath(), &control.Packet{Type: t, Message: legacyMessage(req)})
+	} else {
+		resp, err = client.Send(t, req)
+	}
+	if err != nil {
+		fmt.Println("Unable to send command to server:", err)
+		os.Exit(1)
+	}
+	return resp
+}
+
+// DoCommand sends the request and prints prefix and the response, exiting with an error status if the request failed
+func DoCommand(prefix string, t control.PacketType, req interface{}) {
+	resp := Send(t, req)
+	fmt.Print(prefix)
 	fmt.Println(resp.Message)
+	if resp.Error != nil {
+		os.Exit(1)
+	}
+}
+
+// jsonResponse returns the indented JSON payload of resp, exiting if the request failed
+func jsonResponse(resp *control.Packet) []byte {
+	if resp.Error != nil || (legacy && !json.Valid([]byte(resp.Message))) {
+		fmt.Fprintln(os.Stderr, "Server returned:", resp.Message)
+		os.Exit(1)
+	}
+	if legacy {
+		return []byte(resp.Message)
+	}
+	buf := new(bytes.Buffer)
+	if err := json.Indent(buf, resp.Payload, "", "\t"); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to format response:", err)
+		os.Exit(1)
+	}
+	return buf.Bytes()
+}
+
+// parseDuration parses a duration, additionally allowing a days suffix, e.g. 30d
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func cacheCommand(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	switch args[0] {
+	case "list":
+		DoCommand("Server returned:\n", control.PacketTypeCacheList, nil)
+	case "extend":
+		if len(args) != 3 {
+			usage()
+		}
+		d, err := parseDuration(args[2])
+		if err != nil {
+			fmt.Println("Unable to parse duration:", err)
+			os.Exit(1)
+		}
+		DoCommand("Server returned: ", control.PacketTypeCacheExtend, &control.CacheExtendMessage{ID: args[1], Duration: d})
+	case "evict":
+		if len(args) != 2 {
+			usage()
+		}
+		DoCommand("Server returned: ", control.PacketTypeCacheEvict, args[1])
+	case "export":
+		if len(args) > 2 {
+			usage()
+		}
+		export := jsonResponse(Send(control.PacketTypeCacheExport, nil))
+		if len(args) == 1 {
+			fmt.Println(string(export))
+			return
+		}
+		if err := ioutil.WriteFile(args[1], append(export, '\n'), 0600); err != nil {
+			fmt.Println("Unable to write export:", err)
+			os.Exit(1)
+		}
+	case "import":
+		if len(args) > 2 {
+			usage()
+		}
+		var buf []byte
+		var err error
+		if len(args) == 1 {
+			buf, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			buf, err = ioutil.ReadFile(args[1])
+		}
+		if err != nil {
+			fmt.Println("Unable to read export:", err)
+			os.Exit(1)
+		}
+		if !json.Valid(buf) {
+			fmt.Println("Export is not valid JSON")
+			os.Exit(1)
+		}
+		DoCommand("Server returned: ", control.PacketTypeCacheImport, json.RawMessage(buf))
+	default:
+		fmt.Println("Unknown cache command:", args[0])
+		usage()
+	}
+}
+
+func configCommand(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	switch args[0] {
+	case "validate":
+		if len(args) > 2 {
+			usage()
+		}
+		var path string
+		if len(args) == 2 {
+			// the server may have a different working directory
+			abs, err := filepath.Abs(args[1])
+			if err != nil {
+				fmt.Println("Unable to resolve path:", err)
+				os.Exit(1)
+			}
+			path = abs
+		}
+		DoCommand("Server returned: ", control.PacketTypeConfigValidate, path)
+	case "reload":
+		DoCommand("Server returned: ", control.PacketTypeConfigReload, nil)
+	default:
+		fmt.Println("Unknown config command:", args[0])
+		usage()
+	}
+}
+
+// subscribe prints events of the given types (or all events) as JSON lines until the server closes the connection
+func subscribe(types []string) {
+	if legacy {
+		fmt.Println("Server doesn't support subscriptions")
+		os.Exit(1)
+	}
+	var req interface{}
+	if len(types) > 0 {
+		req = types
+	}
+	resp, err := client.Stream(control.PacketTypeSubscribe, req, func(p *control.Packet) {
+		if p.Type == control.PacketTypeEvent {
+			fmt.Println(string(p.Payload))
+		}
+	})
+	if err != nil {
+		fmt.Println("Unable to send command to server:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Server returned:", resp.Message)
+	if resp.Error != nil {
+		os.Exit(1)
+	}
 }
 
 func usage() {
-	fmt.Printf("Usage: %s [command]:\nCommands:\n\tsync [usernames...]\tsyncs printers, optionally including usernames\n\tclear-cache\t\tclears printer cache\n\tlist-drivers\t\tlists drivers found by CUPS\n", os.Args[0])
+	fmt.Printf("Usage: %s [--quiet] [--socket path] [command]:\nOptions:\n\t--quiet, -q\t\tdon't show progress of long-running commands\n\t--socket path\t\tcontrol socket path (default: $%s or printer-manager.sock in /var/run or /run)\nCommands:\n\tsync [usernames...]\tsyncs printers, optionally including usernames\n\trefresh\t\t\tsyncs your own printers\n\tsubscribe [types...]\tprints events (optionally only of the given types) as JSON lines\n\tclear-cache\t\tclears printer cache\n\tstatus\t\t\tshows daemon status, last sync, and next sync\n\tlist-drivers\t\tlists drivers found by CUPS\n\tlist-printers [--json]\tlists installed and managed printers\n\twhy [printer]\t\tshows why printer is installed\n\tcache list\t\tlists cached printers and their expirations\n\tcache extend [printer] [duration]\n\t\t\t\textends (or shortens, if negative) printer expiration, e.g. 30d or -12h\n\tcache evict [printer]\tdeletes printer and removes it from cache\n\tcache export [file]\texports cache as JSON to file or stdout\n\tcache import [file]\timports cache from JSON file or stdin and installs printers\n\tconfig validate [file]\tvalidates configuration file (or current configuration)\n\tconfig reload\t\treloads configuration\n", os.Args[0], control.SocketEnv)
 	os.Exit(1)
 }
 
 func main() {
+	// --quiet and --socket may be given anywhere
+	args := os.Args[:1]
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "--quiet" || arg == "-q":
+			quiet = true
+		case arg == "--socket":
+			if i+1 == len(os.Args) {
+				usage()
+			}
+			i++
+			socket = os.Args[i]
+		case strings.HasPrefix(arg, "--socket="):
+			socket = strings.TrimPrefix(arg, "--socket=")
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+
 	if len(os.Args) < 2 {
 		usage()
 	}
 	switch os.Args[1] {
+	case "sync", "refresh", "subscribe", "clear-cache", "status", "list-drivers", "list-printers", "why", "cache", "config":
+		// connect before printing output so version warnings aren't interleaved
+		connect()
+	}
+	switch os.Args[1] {
 	case "sync":
+		var users interface{}
 		if len(os.Args) > 2 {
-			users := os.Args[2:len(os.Args)]
-			b, err := json.Marshal(users)
-			if err != nil {
-				fmt.Println("Unable to marshal users:", err)
-				os.Exit(1)
-			}
-			fmt.Print("Server returned: ")
-			DoCommand(&control.Packet{Type: control.PacketTypeSync, Message: string(b)})
-		} else {
-			fmt.Print("Server returned: ")
-			DoCommand(&control.Packet{Type: control.PacketTypeSync})
+			users = os.Args[2:len(os.Args)]
 		}
+		DoCommand("Server returned: ", control.PacketTypeSync, users)
+	case "refresh":
+		DoCommand("Server returned: ", control.PacketTypeSyncUser, nil)
+	case "subscribe":
+		subscribe(os.Args[2:])
 	case "clear-cache":
-		fmt.Print("Server returned: ")
-		DoCommand(&control.Packet{Type: control.PacketTypeClearCache})
+		DoCommand("Server returned: ", control.PacketTypeClearCache, nil)
 		fmt.Println("You will probably want to run the sync command now")
+	case "status":
+		DoCommand("Server returned:\n", control.PacketTypeStatus, nil)
 	case "list-drivers":
-		fmt.Println("Server returned:")
-		DoCommand(&control.Packet{Type: control.PacketTypeListDrivers})
+		DoCommand("Server returned:\n", control.PacketTypeListDrivers, nil)
+	case "list-printers":
+		switch {
+		case len(os.Args) == 2:
+			DoCommand("Server returned:\n", control.PacketTypeListPrinters, nil)
+		case len(os.Args) == 3 && os.Args[2] == "--json":
+			var req interface{}
+			if legacy {
+				req = control.FormatJSON
+			}
+			fmt.Println(string(jsonResponse(Send(control.PacketTypeListPrinters, req))))
+		default:
+			usage()
+		}
+	case "why":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		DoCommand("Server returned:\n", control.PacketTypeWhy, os.Args[2])
+	case "cache":
+		cacheCommand(os.Args[2:])
+	case "config":
+		configCommand(os.Args[2:])
 	default:
 		fmt.Println("Unknown command:", os.Args[1])
 		usage()
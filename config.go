@@ -1,12 +1,239 @@
 package main
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/korylprince/printer-manager-cups/cache"
+	"github.com/korylprince/printer-manager-cups/control"
+	"github.com/korylprince/printer-manager-cups/cups"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DuplicatePolicyDelete  = "delete"
+	DuplicatePolicyDisable = "disable"
+	DuplicatePolicyReport  = "report"
+
+	ActiveJobPolicyDefer = "defer"
+	ActiveJobPolicyDrain = "drain"
+)
 
 type Config struct {
-	APIBase        string        `required:"true"`
+	APIBase        string        `reload:"true"`
 	CachePath      string        `default:"/etc/printer-manager"`
-	CacheTime      time.Duration `default:"336h"` // 14 days
-	SyncInterval   time.Duration `default:"1h"`
-	IgnoreUsers    []string      `default:"root"`
-	IgnoreUserCase bool          `default:"false"`
+	CacheBackend   string        `default:"badger"` // badger, json, or bolt
+	CacheTime      time.Duration `default:"336h"`   // 14 days
+	UserCacheTime  time.Duration `default:"336h"`   // how long a user can go unseen before their printers expire
+	SyncInterval   time.Duration `default:"1h" reload:"true"`
+	IgnoreUsers    []string      `default:"root" reload:"true"`
+	IgnoreUserCase bool          `default:"false" reload:"true"`
+	// DuplicatePolicy is the action taken on unmanaged printers matching a managed printer: delete, disable, or report
+	DuplicatePolicy     string `default:"delete"`
+	DuplicateResolveDNS bool   `default:"false"`
+	// ProtectedPrinters is a list of glob patterns of CUPS printer names that will never be deleted or modified
+	ProtectedPrinters []string
+	ProtectedPrefix   string
+	ProtectedMarker   string `default:"[protected]"`
+	// ActiveJobPolicy is the action taken when deleting a printer with active jobs: defer (to the next sync) or drain
+	ActiveJobPolicy string        `default:"defer"`
+	DrainTimeout    time.Duration `default:"5m"`
+	// AdminGroups are the groups whose members (in addition to root) may run any control command
+	AdminGroups []string `default:"lpadmin,wheel" reload:"true"`
+	// UserSyncInterval is the minimum time between self-service syncs for each user
+	UserSyncInterval time.Duration `default:"1m" reload:"true"`
+	// DriverFuzzyThreshold is the minimum score (0 to 1) of a fuzzy:-prefixed driver match
+	DriverFuzzyThreshold float64 `default:"0.5"`
+	// DriverEverywherePolicy is when IPP Everywhere is chosen if listed: fallback (if no PPDs match), prefer, or order (if listed first)
+	DriverEverywherePolicy string `default:"fallback"`
+	// DriverFamilies are preferred driver families, most preferred first, e.g. hpcups,foomatic
+	DriverFamilies []string
+	// SocketPath is the control socket path. If empty, printer-manager.sock in /var/run or /run is used
+	SocketPath string
+	// SocketGroup is the optional name or ID of the group owning the control socket
+	SocketGroup string
+	// SocketMode is the octal control socket permissions
+	SocketMode string `default:"0777"`
+	// HTTPListen is the optional address of the HTTP admin API: a localhost host:port, or unix:path for a unix socket
+	HTTPListen string
+	// HTTPToken is the bearer token required by the HTTP admin API
+	HTTPToken string
+}
+
+// PPDDir is the directory in CachePath downloaded PPD files are stored in
+const PPDDir = "ppds"
+
+// ConfigFileEnv is the environment variable used for the config file path if the -config flag isn't given
+const ConfigFileEnv = "CONFIGFILE"
+
+// LoadConfig returns the Config read from the optional YAML file at path and environment variables,
+// or an error if one occurred or the Config is invalid. Environment variables override the file
+func LoadConfig(path string) (*Config, error) {
+	c := new(Config)
+	if err := envconfig.Process("", c); err != nil {
+		return nil, fmt.Errorf("Unable to process environment: %w", err)
+	}
+
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, fmt.Errorf("Unable to load %s: %w", path, err)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadFile sets Config fields from the YAML file at path, skipping fields set by environment variables
+func (c *Config) loadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read file: %w", err)
+	}
+
+	nodes := make(map[string]yaml.Node)
+	if err = yaml.Unmarshal(buf, &nodes); err != nil {
+		return fmt.Errorf("Unable to parse file: %w", err)
+	}
+
+	v := reflect.ValueOf(c).Elem()
+	fields := make(map[string]int)
+	for i := 0; i < v.NumField(); i++ {
+		fields[strings.ToLower(v.Type().Field(i).Name)] = i
+	}
+
+	for key, node := range nodes {
+		idx, ok := fields[strings.ToLower(key)]
+		if !ok {
+			return fmt.Errorf("Unknown key: %s", key)
+		}
+		// envconfig uses the uppercased field name when no prefix is given
+		if _, ok := os.LookupEnv(strings.ToUpper(v.Type().Field(idx).Name)); ok {
+			continue
+		}
+		if err = node.Decode(v.Field(idx).Addr().Interface()); err != nil {
+			return fmt.Errorf("Unable to decode %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Reload copies fields tagged reload:"true" from n to c and returns the names of changed fields that require a restart
+func (c *Config) Reload(n *Config) []string {
+	var restart []string
+	cv, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(n).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		f := cv.Type().Field(i)
+		if reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if f.Tag.Get("reload") != "true" {
+			restart = append(restart, f.Name)
+			continue
+		}
+		cv.Field(i).Set(nv.Field(i))
+	}
+	return restart
+}
+
+// Validate returns an error if the Config is invalid
+func (c *Config) Validate() error {
+	if c.APIBase == "" {
+		return errors.New("APIBase is required")
+	}
+	switch c.DuplicatePolicy {
+	case DuplicatePolicyDelete, DuplicatePolicyDisable, DuplicatePolicyReport:
+	default:
+		return fmt.Errorf("Invalid DuplicatePolicy: %s", c.DuplicatePolicy)
+	}
+	switch c.CacheBackend {
+	case cache.BackendBadger, cache.BackendJSON, cache.BackendBolt:
+	default:
+		return fmt.Errorf("Invalid CacheBackend: %s", c.CacheBackend)
+	}
+	switch c.ActiveJobPolicy {
+	case ActiveJobPolicyDefer, ActiveJobPolicyDrain:
+	default:
+		return fmt.Errorf("Invalid ActiveJobPolicy: %s", c.ActiveJobPolicy)
+	}
+	if c.DriverFuzzyThreshold <= 0 || c.DriverFuzzyThreshold > 1 {
+		return fmt.Errorf("Invalid DriverFuzzyThreshold: %v", c.DriverFuzzyThreshold)
+	}
+	switch c.DriverEverywherePolicy {
+	case cups.EverywhereFallback, cups.EverywherePrefer, cups.EverywhereOrder:
+	default:
+		return fmt.Errorf("Invalid DriverEverywherePolicy: %s", c.DriverEverywherePolicy)
+	}
+	if _, err := c.socketMode(); err != nil {
+		return err
+	}
+	if c.HTTPListen != "" {
+		if c.HTTPToken == "" {
+			return errors.New("HTTPToken is required when HTTPListen is set")
+		}
+		if network, addr := c.httpAddr(); network == "tcp" && !isLoopback(addr) {
+			return fmt.Errorf("Invalid HTTPListen: %s is not a localhost address", addr)
+		}
+	}
+	for _, pattern := range c.ProtectedPrinters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid ProtectedPrinters pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// socketMode returns the parsed SocketMode, or an error if it's invalid
+func (c *Config) socketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid SocketMode: %s", c.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// DriverPolicy returns the driver selection policy
+func (c *Config) DriverPolicy() *cups.DriverPolicy {
+	return &cups.DriverPolicy{Everywhere: c.DriverEverywherePolicy, Families: c.DriverFamilies, FuzzyThreshold: c.DriverFuzzyThreshold}
+}
+
+// SocketOptions returns the control socket options
+func (c *Config) SocketOptions() *control.SocketOptions {
+	// SocketMode is checked by Validate
+	mode, _ := c.socketMode()
+	return &control.SocketOptions{Path: c.SocketPath, Group: c.SocketGroup, Mode: mode}
+}
+
+// httpAddr returns the network and address of HTTPListen
+func (c *Config) httpAddr() (network, addr string) {
+	if strings.HasPrefix(c.HTTPListen, "unix:") {
+		return "unix", strings.TrimPrefix(c.HTTPListen, "unix:")
+	}
+	return "tcp", c.HTTPListen
+}
+
+// isLoopback returns true if the host of addr is localhost or a loopback IP
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
@@ -0,0 +1,118 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+//ErrLegacyServer is returned by Dial when the server only supports the legacy protocol
+var ErrLegacyServer = errors.New("server only supports the legacy protocol")
+
+//Client is a connection to the control socket using the versioned protocol
+type Client struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+	next int
+	//ProtocolVersion is the negotiated protocol version
+	ProtocolVersion int
+	//ServerVersion is the server's software version
+	ServerVersion string
+	//Progress, if set, requests streaming and is called with each progress message received before a response
+	Progress func(msg string)
+}
+
+//Dial connects to the control socket at sock and negotiates the protocol version, sending version as the client's software version.
+//ErrLegacyServer is returned if the server doesn't support the versioned protocol
+func Dial(sock, version string) (*Client, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial %s: %w", sock, err)
+	}
+
+	c := &Client{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn), ProtocolVersion: ProtocolVersion}
+
+	hello := new(HelloMessage)
+	if err = c.Call(PacketTypeHello, &HelloMessage{ProtocolVersion: ProtocolVersion, Version: version}, hello); err != nil {
+		conn.Close()
+		// legacy servers close the connection on unknown packet types
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrLegacyServer
+		}
+		return nil, fmt.Errorf("Unable to negotiate protocol version: %w", err)
+	}
+
+	c.ProtocolVersion = hello.ProtocolVersion
+	c.ServerVersion = hello.Version
+	return c, nil
+}
+
+//Send sends a request of type t with the JSON-encoded req as payload (if not nil) and returns the response Packet,
+//or an error if one occurred. Failed responses are returned with their Error set
+func (c *Client) Send(t PacketType, req interface{}) (*Packet, error) {
+	return c.Stream(t, req, func(p *Packet) {
+		if p.Type == PacketTypeProgress && c.Progress != nil {
+			c.Progress(p.Message)
+		}
+	})
+}
+
+//Stream is like Send, but calls f with each Packet (e.g. progress or events) received before the response
+func (c *Client) Stream(t PacketType, req interface{}, f func(p *Packet)) (*Packet, error) {
+	c.next++
+	p := &Packet{Type: t, Version: c.ProtocolVersion, ID: strconv.Itoa(c.next), Stream: c.Progress != nil}
+	if req != nil {
+		buf, err := json.Marshal(req)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to marshal request: %w", err)
+		}
+		p.Payload = buf
+	}
+
+	if err := c.enc.Encode(p); err != nil {
+		return nil, fmt.Errorf("Unable to encode packet: %w", err)
+	}
+
+	for {
+		resp := new(Packet)
+		if err := c.dec.Decode(resp); err != nil {
+			return nil, fmt.Errorf("Unable to decode response: %w", err)
+		}
+		if resp.ID != p.ID {
+			continue
+		}
+		if resp.Type != PacketTypeResponse {
+			f(resp)
+			continue
+		}
+		return resp, nil
+	}
+}
+
+//Call sends a request of type t with payload req (if not nil) and decodes the response payload into resp (if not nil),
+//or returns an error if one occurred. Failed responses return an *Error
+func (c *Client) Call(t PacketType, req, resp interface{}) error {
+	p, err := c.Send(t, req)
+	if err != nil {
+		return err
+	}
+	if p.Error != nil {
+		return p.Error
+	}
+	if resp == nil {
+		return nil
+	}
+	if err = json.Unmarshal(p.Payload, resp); err != nil {
+		return fmt.Errorf("Unable to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+//Close closes the connection, or returns an error if one occurred
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
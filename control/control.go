@@ -3,13 +3,18 @@
 package control
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/user"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type PacketType int
@@ -22,15 +27,161 @@ const (
 	PacketTypeResponse
 	PacketTypeClearCache
 	PacketTypeListDrivers
+	PacketTypeWhy
+	PacketTypeCacheList
+	PacketTypeCacheExtend
+	PacketTypeCacheEvict
+	PacketTypeCacheExport
+	PacketTypeCacheImport
+	PacketTypeConfigValidate
+	PacketTypeConfigReload
+	PacketTypeStatus
+	PacketTypeListPrinters
+	PacketTypeHello
+	PacketTypeSyncUser
+	PacketTypeProgress
+	PacketTypeSubscribe
+	PacketTypeEvent
 )
 
+//FormatJSON is the Message of a PacketTypeListPrinters Packet requesting JSON output instead of a table
+const FormatJSON = "json"
+
+//ProtocolVersion is the current control protocol version.
+//Legacy Packets have no version; they carry a single request per connection and only use Type and Message
+const ProtocolVersion = 2
+
+//ProgressBuffer is the number of progress messages buffered for each request.
+//Messages are dropped for clients with full buffers, so slow clients can't block the handler
+const ProgressBuffer = 64
+
 //Packet represents a control packet
 type Packet struct {
 	Type    PacketType `json:"type"`
 	Message string     `json:"msg"`
+	//Version is the protocol version of the Packet, or 0 for legacy Packets
+	Version int `json:"version,omitempty"`
+	//ID identifies a request; it's copied to the response
+	ID string `json:"id,omitempty"`
+	//Payload is the JSON-encoded typed request or response
+	Payload json.RawMessage `json:"payload,omitempty"`
+	//Error is set on failed responses
+	Error *Error `json:"error,omitempty"`
+	//Stream requests PacketTypeProgress Packets be sent before the response
+	Stream bool `json:"stream,omitempty"`
+	//Peer is the process that sent the request, or nil if it's unknown. It's set by the Listener
+	Peer *Peer `json:"-"`
+
+	ctx      context.Context
+	send     func(resp *Packet) error
+	progress func(msg string)
+}
+
+//Context returns a Context that's canceled when the client closes the connection
+func (p *Packet) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+//Progress queues msg to be sent to the client as a PacketTypeProgress Packet if it requested streaming, otherwise it does nothing.
+//Progress doesn't block; msg is dropped if the client isn't keeping up
+func (p *Packet) Progress(msg string) {
+	if p.Stream && p.progress != nil {
+		p.progress(msg)
+	}
 }
 
-//GetSocket returns a control socket path, or an error if none exists
+//Emit sends a Packet of type t with msg and the JSON-encoded payload to the client before the response,
+//or returns an error if one occurred. Legacy clients don't support Emit
+func (p *Packet) Emit(t PacketType, msg string, payload interface{}) error {
+	if p.send == nil {
+		return Errorf(ErrorCodeUnsupportedVersion, "Streaming requires protocol version %d", ProtocolVersion)
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal payload: %w", err)
+	}
+	return p.send(&Packet{Type: t, Message: msg, Payload: buf})
+}
+
+//Peer identifies the process connected to the control socket
+type Peer struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+func (p *Peer) String() string {
+	if p == nil {
+		return "unknown peer"
+	}
+	return fmt.Sprintf("pid %d (uid %d, gid %d)", p.PID, p.UID, p.GID)
+}
+
+//Legacy returns true if p uses the legacy protocol
+func (p *Packet) Legacy() bool {
+	return p.Version == 0
+}
+
+//Decode decodes the request in p into v, or returns an error if one occurred.
+//For legacy Packets, a string v is set to Message; otherwise Message is decoded as JSON
+func (p *Packet) Decode(v interface{}) error {
+	if len(p.Payload) > 0 {
+		return json.Unmarshal(p.Payload, v)
+	}
+	if s, ok := v.(*string); ok {
+		*s = p.Message
+		return nil
+	}
+	if p.Message == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(p.Message), v)
+}
+
+//HelloMessage is the Payload of a PacketTypeHello request and response
+type HelloMessage struct {
+	//ProtocolVersion is the highest version supported by the client in the request, and the negotiated version in the response
+	ProtocolVersion int `json:"protocol_version"`
+	//Version is the software version of the sender
+	Version string `json:"version"`
+}
+
+//Result is a handler result with a human-readable Message and a typed Payload
+type Result struct {
+	Message string
+	Payload interface{}
+}
+
+//Handler handles a request Packet and returns the result or an error.
+//Results are rendered for legacy clients as: strings as is, fmt.Stringers with String, and other types as JSON
+type Handler func(p *Packet) (interface{}, error)
+
+//CacheExtendMessage is the JSON-encoded Message of a PacketTypeCacheExtend Packet
+type CacheExtendMessage struct {
+	ID       string        `json:"id"`
+	Duration time.Duration `json:"duration"`
+}
+
+//SocketEnv is the environment variable used for the control socket path by the server and client
+const SocketEnv = "SOCKETPATH"
+
+//DefaultSocketMode is the default control socket permissions
+const DefaultSocketMode os.FileMode = 0777
+
+//SocketOptions configures the control socket
+type SocketOptions struct {
+	//Path is the socket path. If empty, the path from GetSocket is used
+	Path string
+	//Group, if set, is the name or ID of the group owning the socket
+	Group string
+	//Mode is the socket permissions
+	Mode os.FileMode
+}
+
+//GetSocket returns the default control socket path in the first existing SearchPaths directory, or an error if none exists
 func GetSocket() (string, error) {
 	for _, path := range SearchPaths {
 		if _, err := os.Stat(path); !os.IsNotExist(err) {
@@ -44,57 +195,287 @@ func GetSocket() (string, error) {
 type Listener struct {
 	Socket     string
 	listener   net.Listener
-	handlers   map[PacketType]func(p *Packet) *Packet
+	handlers   map[PacketType]Handler
 	handlersMu *sync.RWMutex
+	closed     chan struct{}
+	//Version is the server software version sent to clients
+	Version string
+	//Authorize, if set, is called before running a handler. If it returns an error, the request is denied
+	Authorize func(p *Packet) error
+	//activated is true if the socket is owned by systemd
+	activated bool
 }
 
 func (l *Listener) worker() {
 	for {
 		conn, err := l.listener.Accept()
 		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
 			log.Println("WARN: Unable to accept control message:", err)
 			continue
 		}
 
+		go l.serve(conn)
+	}
+}
+
+//serve handles requests on conn until the client closes it, or after the first request for legacy clients
+func (l *Listener) serve(conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println("WARN: Error closing conn:", err)
+		}
+	}()
+
+	peer, err := peerCred(conn)
+	if err != nil {
+		log.Println("WARN: Unable to identify control client:", err)
+	}
+
+	// ctx is canceled when the client closes the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	packets := make(chan *Packet)
+	go func() {
+		defer cancel()
+		defer close(packets)
 		d := json.NewDecoder(conn)
-		p := new(Packet)
-		if err = d.Decode(p); err != nil {
-			conn.Close()
-			log.Println("WARN: Unable to decode control message:", err)
-			continue
+		for {
+			p := new(Packet)
+			if err := d.Decode(p); err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.Println("WARN: Unable to decode control message:", err)
+				}
+				return
+			}
+			select {
+			case packets <- p:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		l.handlersMu.RLock()
-		f, ok := l.handlers[p.Type]
-		l.handlersMu.RUnlock()
-		if !ok || f == nil {
-			conn.Close()
-			log.Printf("WARN: Unregistered handler for PacketType: %s\n", p.Type.String())
-			continue
+	e := json.NewEncoder(conn)
+	// packets may be sent before the response from other goroutines
+	var mu sync.Mutex
+	for p := range packets {
+		p.Peer = peer
+		p.ctx = ctx
+
+		done := false
+		if !p.Legacy() {
+			req := p
+			p.send = func(resp *Packet) error {
+				mu.Lock()
+				defer mu.Unlock()
+				// drop packets sent after the response
+				if done {
+					return errors.New("Response already sent")
+				}
+				resp.Version, resp.ID = req.Version, req.ID
+				if err := e.Encode(resp); err != nil {
+					return fmt.Errorf("Unable to encode packet: %w", err)
+				}
+				return nil
+			}
 		}
 
-		log.Printf("INFO: Running handler for control message: %s\n", p.Type.String())
+		flush := func() {}
+		if p.send != nil && p.Stream {
+			flush = l.streamProgress(p)
+		}
 
-		go func() {
-			resp := f(p)
-			e := json.NewEncoder(conn)
-			if err = e.Encode(resp); err != nil {
-				conn.Close()
-				return
+		var resp *Packet
+		if p.Type == PacketTypeHello {
+			resp = l.hello(p)
+		} else {
+			resp = l.handle(p)
+		}
+
+		// send queued progress before the response
+		flush()
+
+		mu.Lock()
+		done = true
+		err := e.Encode(resp)
+		mu.Unlock()
+		if err != nil {
+			log.Println("WARN: Unable to encode control response:", err)
+			return
+		}
+
+		if p.Legacy() {
+			return
+		}
+	}
+}
+
+//streamProgress sets p.progress to queue messages to be sent by another goroutine with p.send,
+//and returns a function that stops queuing and waits for queued messages to be sent
+func (l *Listener) streamProgress(p *Packet) func() {
+	msgs := make(chan string, ProgressBuffer)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for msg := range msgs {
+			if err := p.send(&Packet{Type: PacketTypeProgress, Message: msg}); err != nil {
+				log.Println("WARN: Unable to send progress:", err)
 			}
+		}
+	}()
+
+	var mu sync.Mutex
+	closed := false
+	p.progress = func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case msgs <- msg:
+		default:
+			log.Println("WARN: Dropped progress message for slow control client")
+		}
+	}
+
+	return func() {
+		mu.Lock()
+		closed = true
+		close(msgs)
+		mu.Unlock()
+		<-sent
+	}
+}
+
+//hello negotiates the protocol version with the client
+func (l *Listener) hello(p *Packet) *Packet {
+	resp := &Packet{Type: PacketTypeResponse, Version: ProtocolVersion, ID: p.ID}
+	version := p.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < ProtocolVersion {
+		resp.Error = Errorf(ErrorCodeUnsupportedVersion, "Unsupported protocol version: %d", p.Version)
+		resp.Message = resp.Error.Message
+		return resp
+	}
+
+	resp.Version = version
+	resp.Payload, _ = json.Marshal(&HelloMessage{ProtocolVersion: version, Version: l.Version})
+	return resp
+}
+
+//Handle runs the handler registered for a request of type t with the JSON-encoded payload (if not nil) and returns the response,
+//for serving requests received by other transports. Authorize isn't called, so the caller must authenticate the request
+func (l *Listener) Handle(ctx context.Context, t PacketType, payload json.RawMessage) *Packet {
+	return l.dispatch(&Packet{Type: t, Version: ProtocolVersion, Payload: payload, ctx: ctx}, false)
+}
 
-			if err = conn.Close(); err != nil {
-				log.Println("WARN: Error closing conn:", err)
+//handle runs the registered handler for p and returns the response
+func (l *Listener) handle(p *Packet) *Packet {
+	return l.dispatch(p, true)
+}
+
+//dispatch runs the handler for p, first calling Authorize if authorize is true, and returns the response
+func (l *Listener) dispatch(p *Packet, authorize bool) *Packet {
+	resp := &Packet{Type: PacketTypeResponse, Version: p.Version, ID: p.ID}
+
+	l.handlersMu.RLock()
+	f, ok := l.handlers[p.Type]
+	l.handlersMu.RUnlock()
+
+	var result interface{}
+	var err error
+	switch {
+	case p.Version > ProtocolVersion:
+		err = Errorf(ErrorCodeUnsupportedVersion, "Unsupported protocol version: %d", p.Version)
+	case !ok || f == nil:
+		log.Printf("WARN: Unregistered handler for PacketType: %s\n", p.Type.String())
+		err = Errorf(ErrorCodeUnknownType, "Unknown packet type: %s", p.Type.String())
+	default:
+		if authorize && l.Authorize != nil {
+			if err = l.Authorize(p); err != nil {
+				log.Printf("WARN: Denied control message %s from %s: %v\n", p.Type.String(), p.Peer, err)
+				break
 			}
-		}()
+		}
+		log.Printf("INFO: Running handler for control message: %s\n", p.Type.String())
+		result, err = f(p)
+	}
+
+	if err != nil {
+		cerr := toError(err)
+		resp.Message = cerr.Message
+		if !p.Legacy() {
+			resp.Error = cerr
+		}
+		return resp
+	}
+
+	var payload interface{}
+	resp.Message, payload = render(result)
+	if p.Legacy() {
+		return resp
+	}
+
+	if resp.Payload, err = json.Marshal(payload); err != nil {
+		resp.Error = Errorf(ErrorCodeInternal, "Unable to marshal payload: %v", err)
+	}
+	return resp
+}
+
+//render returns the human-readable Message and Payload for a handler result
+func render(result interface{}) (string, interface{}) {
+	switch r := result.(type) {
+	case *Result:
+		return r.Message, r.Payload
+	case string:
+		return r, r
+	case json.RawMessage:
+		return string(r), r
+	case fmt.Stringer:
+		return r.String(), r
 	}
+	buf, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		return fmt.Sprintf("Unable to marshal result: %v", err), result
+	}
+	return string(buf), result
 }
 
-//New returns a new Listener or an error if one occurred
-func New() (*Listener, error) {
-	sock, err := GetSocket()
+//New returns a new Listener on the socket configured by opts or an error if one occurred.
+//An error is returned if another server is already listening on the socket
+func New(opts *SocketOptions) (*Listener, error) {
+	sock := opts.Path
+	if sock == "" {
+		var err error
+		if sock, err = GetSocket(); err != nil {
+			return nil, fmt.Errorf("Unable to get socket: %w", err)
+		}
+	}
+
+	l, err := ListenUnix(sock, opts)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get socket: %w", err)
+		return nil, err
+	}
+
+	return newListener(sock, l, false), nil
+}
+
+//ListenUnix listens on the unix socket at sock, setting its group and permissions from opts,
+//or returns an error if one occurred. An error is returned if another server is already listening on the socket
+func ListenUnix(sock string, opts *SocketOptions) (net.Listener, error) {
+	// don't steal the socket from a running server
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("Another server is already listening on %s", sock)
 	}
 
 	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
@@ -106,34 +487,82 @@ func New() (*Listener, error) {
 		return nil, fmt.Errorf("Unable to listen on %s: %w", sock, err)
 	}
 
-	if err = os.Chmod(sock, 0777); err != nil {
-		return nil, fmt.Errorf("Unable to set permissions for socket: %w", err)
+	if err = setOwnership(sock, opts); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+//setOwnership sets the group and permissions of sock from opts, or returns an error if one occurred
+func setOwnership(sock string, opts *SocketOptions) error {
+	if opts.Group != "" {
+		g, err := user.LookupGroup(opts.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(opts.Group); err != nil {
+				return fmt.Errorf("Unable to find socket group %s: %w", opts.Group, err)
+			}
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("Unable to parse socket group ID %s: %w", g.Gid, err)
+		}
+		if err = os.Chown(sock, -1, gid); err != nil {
+			return fmt.Errorf("Unable to set group for socket: %w", err)
+		}
+	}
+
+	if err := os.Chmod(sock, opts.Mode); err != nil {
+		return fmt.Errorf("Unable to set permissions for socket: %w", err)
 	}
 
+	return nil
+}
+
+//NewFromListener returns a new Listener using an existing listener, e.g. from systemd socket activation.
+//The socket is not removed when the Listener is closed
+func NewFromListener(l net.Listener) *Listener {
+	return newListener(l.Addr().String(), l, true)
+}
+
+func newListener(sock string, l net.Listener, activated bool) *Listener {
 	lis := &Listener{Socket: sock,
 		listener:   l,
-		handlers:   make(map[PacketType]func(*Packet) *Packet),
+		handlers:   make(map[PacketType]Handler),
 		handlersMu: new(sync.RWMutex),
+		closed:     make(chan struct{}),
+		activated:  activated,
 	}
 	go lis.worker()
 
-	return lis, nil
+	return lis
+}
+
+//Close stops listening and removes the socket, or returns an error if one occurred
+func (l *Listener) Close() error {
+	close(l.closed)
+	if err := l.listener.Close(); err != nil {
+		return fmt.Errorf("Unable to close listener: %w", err)
+	}
+	if l.activated {
+		return nil
+	}
+	if err := os.Remove(l.Socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove socket: %w", err)
+	}
+	return nil
 }
 
 //Register registers the given handler for the given Packet type
-func (l *Listener) Register(t PacketType, handler func(p *Packet) *Packet) {
+func (l *Listener) Register(t PacketType, handler Handler) {
 	l.handlersMu.Lock()
 	l.handlers[t] = handler
 	l.handlersMu.Unlock()
 }
 
-//Do sends the given control packet and returns the response, or an error if one occurred
-func Do(p *Packet) (*Packet, error) {
-	sock, err := GetSocket()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to get socket: %w", err)
-	}
-
+//Do sends the given control packet to the socket at sock and returns the response, or an error if one occurred
+func Do(sock string, p *Packet) (*Packet, error) {
 	conn, err := net.Dial("unix", sock)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to dial %s: %w", sock, err)
@@ -0,0 +1,51 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+)
+
+//ErrorCode identifies the kind of a failed request
+type ErrorCode string
+
+//Error codes
+const (
+	//ErrorCodeUnknownType is returned for Packet types without a registered handler
+	ErrorCodeUnknownType ErrorCode = "unknown_type"
+	//ErrorCodeUnsupportedVersion is returned for unsupported protocol versions
+	ErrorCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	//ErrorCodeBadRequest is returned for malformed requests
+	ErrorCodeBadRequest ErrorCode = "bad_request"
+	//ErrorCodeForbidden is returned when the client isn't authorized to make the request
+	ErrorCodeForbidden ErrorCode = "forbidden"
+	//ErrorCodeRateLimited is returned when the client has made too many requests
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	//ErrorCodeNotFound is returned when the requested object doesn't exist
+	ErrorCodeNotFound ErrorCode = "not_found"
+	//ErrorCodeInternal is returned when the request failed on the server
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+//Error is a failed response
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+//Errorf returns a new Error with the given code and formatted message
+func Errorf(code ErrorCode, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+//toError returns err as an *Error, using err's message and ErrorCodeInternal if err doesn't wrap an *Error
+func toError(err error) *Error {
+	var cerr *Error
+	if errors.As(err, &cerr) {
+		return &Error{Code: cerr.Code, Message: err.Error()}
+	}
+	return &Error{Code: ErrorCodeInternal, Message: err.Error()}
+}
@@ -12,11 +12,26 @@ func _() {
 	_ = x[PacketTypeResponse-1]
 	_ = x[PacketTypeClearCache-2]
 	_ = x[PacketTypeListDrivers-3]
+	_ = x[PacketTypeWhy-4]
+	_ = x[PacketTypeCacheList-5]
+	_ = x[PacketTypeCacheExtend-6]
+	_ = x[PacketTypeCacheEvict-7]
+	_ = x[PacketTypeCacheExport-8]
+	_ = x[PacketTypeCacheImport-9]
+	_ = x[PacketTypeConfigValidate-10]
+	_ = x[PacketTypeConfigReload-11]
+	_ = x[PacketTypeStatus-12]
+	_ = x[PacketTypeListPrinters-13]
+	_ = x[PacketTypeHello-14]
+	_ = x[PacketTypeSyncUser-15]
+	_ = x[PacketTypeProgress-16]
+	_ = x[PacketTypeSubscribe-17]
+	_ = x[PacketTypeEvent-18]
 }
 
-const _PacketType_name = "PacketTypeSyncPacketTypeResponsePacketTypeClearCachePacketTypeListDrivers"
+const _PacketType_name = "PacketTypeSyncPacketTypeResponsePacketTypeClearCachePacketTypeListDriversPacketTypeWhyPacketTypeCacheListPacketTypeCacheExtendPacketTypeCacheEvictPacketTypeCacheExportPacketTypeCacheImportPacketTypeConfigValidatePacketTypeConfigReloadPacketTypeStatusPacketTypeListPrintersPacketTypeHelloPacketTypeSyncUserPacketTypeProgressPacketTypeSubscribePacketTypeEvent"
 
-var _PacketType_index = [...]uint8{0, 14, 32, 52, 73}
+var _PacketType_index = [...]uint16{0, 14, 32, 52, 73, 86, 105, 126, 146, 167, 188, 212, 234, 250, 272, 287, 305, 323, 342, 357}
 
 func (i PacketType) String() string {
 	if i < 0 || i >= PacketType(len(_PacketType_index)-1) {
@@ -0,0 +1,33 @@
+package control
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+//peerCred returns the credentials of the process connected to conn, or an error if one occurred
+func peerCred(conn net.Conn) (*Peer, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported connection type: %T", conn)
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get raw connection: %w", err)
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, fmt.Errorf("Unable to control connection: %w", err)
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("Unable to get peer credentials: %w", credErr)
+	}
+
+	return &Peer{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
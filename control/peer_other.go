@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package control
+
+import (
+	"errors"
+	"net"
+)
+
+//peerCred is only supported on Linux
+func peerCred(conn net.Conn) (*Peer, error) {
+	return nil, errors.New("Peer credentials are not supported on this platform")
+}
@@ -1,13 +1,17 @@
 package cups
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"os/exec"
 	"os/user"
+	"sync"
 	"time"
 
+	"github.com/korylprince/printer-manager-cups/progress"
 	"github.com/korylprince/printer-manager-cups/retry"
 	"github.com/phin1x/go-ipp"
 )
@@ -18,13 +22,24 @@ const EverywhereDriver = "everywhere"
 
 var ErrUnsuccessfulPrinterCommunication = errors.New("unsuccessful printer communication")
 
+// ErrActiveJobs is returned when a Printer still has active jobs after draining
+var ErrActiveJobs = errors.New("printer has active jobs")
+
+// DrainPollInterval is how often a draining Printer is checked for active jobs
+var DrainPollInterval = 5 * time.Second
+
 // Client is a CUPS client that connects over unix sockets
 type Client struct {
 	client       *ipp.IPPClient
 	adapter      ipp.Adapter
 	CacheTimeout time.Duration
-	cache        map[string]string
-	cacheTime    time.Time
+	// DriverPolicy controls how drivers are chosen
+	DriverPolicy *DriverPolicy
+	// FetchPPD, if set, returns the local path of a Printer's PPDFile, downloading it if necessary
+	FetchPPD  func(ctx context.Context, f *PPDFile) (path string, err error)
+	cache     map[string]string
+	cacheTime time.Time
+	cacheMu   sync.Mutex
 }
 
 // New returns a new client or an error if one occurred
@@ -39,6 +54,7 @@ func New() (*Client, error) {
 		client:       ipp.NewIPPClientWithAdapter(user.Username, adapter),
 		adapter:      adapter,
 		CacheTimeout: DefaultCacheTimeout,
+		DriverPolicy: DefaultDriverPolicy(),
 	}, nil
 }
 
@@ -69,6 +85,8 @@ func (c *Client) getPPDs() (map[string]string, error) {
 
 // GetPPDs returns the a mapping of make-and-model to name for all PPDs installed or an error if one occurred
 func (c *Client) GetPPDs() (map[string]string, error) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
 	if c.cache != nil && time.Since(c.cacheTime) < c.CacheTimeout {
 		return c.cache, nil
 	}
@@ -99,10 +117,22 @@ func (c *Client) GetDefault() (string, error) {
 	return (resp.PrinterAttributes[0][ipp.AttributePrinterName][0].Value).(string), nil
 }
 
+// PPDFile references a PPD file to download
+type PPDFile struct {
+	// URL is the file URL, optionally relative to the API base URL
+	URL string `json:"url"`
+	// SHA256 is the hex-encoded SHA-256 checksum of the file
+	SHA256 string `json:"sha256"`
+}
+
 // CUPS hold CUPS-specific driver options
 type CUPS struct {
-	DriverName      []string          `json:"driver_name"`
-	URITemplate     string            `json:"uri_template"`
+	// DriverName is a list of driver specs tried in order: exact ppd-make-and-model values,
+	// prefixed specs (see DriverPrefixRegex, etc.), or EverywhereDriver
+	DriverName  []string `json:"driver_name"`
+	URITemplate string   `json:"uri_template"`
+	// PPD is an optional PPD file uploaded with the printer if no installed PPDs match DriverName
+	PPD             *PPDFile          `json:"ppd,omitempty"`
 	DefaultPriority int               `json:"default_priority"`
 	Options         map[string]string `json:"options"`
 	Override        struct {
@@ -139,6 +169,14 @@ func (p *Printer) GetLocation() string {
 	return p.Location
 }
 
+// DeviceURI returns the device URI generated from the Printer's URITemplate and Hostname
+func (p *Printer) DeviceURI() string {
+	if p.Driver == nil || p.Driver.CUPS == nil {
+		return ""
+	}
+	return fmt.Sprintf(p.URITemplate, p.Hostname)
+}
+
 // GetPrinters returns all the installed Printers or an error if one occurred
 func (c *Client) GetPrinters() ([]*Printer, error) {
 	r := ipp.NewRequest(ipp.OperationCupsGetPrinters, rand.Int31())
@@ -176,57 +214,120 @@ func (c *Client) GetPrinters() ([]*Printer, error) {
 	return printers, nil
 }
 
-// AddOrModify creates or updates the Printer or returns an error if one occurred
-func (c *Client) AddOrModify(p *Printer) error {
+// PrinterState is the state of an installed Printer
+type PrinterState struct {
+	// State is idle, processing, or stopped
+	State        string   `json:"state"`
+	Reasons      []string `json:"reasons"`
+	MakeAndModel string   `json:"make_and_model"`
+}
+
+var printerStates = map[int]string{
+	int(ipp.PrinterStateIdle):       "idle",
+	int(ipp.PrinterStateProcessing): "processing",
+	int(ipp.PrinterStateStopped):    "stopped",
+}
+
+// GetPrinterStates returns a mapping of Printer ID to PrinterState for all installed Printers or an error if one occurred
+func (c *Client) GetPrinterStates() (map[string]*PrinterState, error) {
+	r := ipp.NewRequest(ipp.OperationCupsGetPrinters, rand.Int31())
+	r.OperationAttributes[ipp.AttributeRequestedAttributes] = []string{ipp.AttributePrinterName, ipp.AttributePrinterState, ipp.AttributePrinterStateReasons, ipp.AttributePrinterMakeAndModel}
+	resp, err := c.client.SendRequest(c.adminURL(), r, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to complete IPP request: %w", err)
+	}
+
+	states := make(map[string]*PrinterState, len(resp.PrinterAttributes))
+
+	for _, a := range resp.PrinterAttributes {
+		val := a[ipp.AttributePrinterName]
+		if len(val) != 1 {
+			continue
+		}
+		s := new(PrinterState)
+		states[(val[0].Value).(string)] = s
+
+		if val := a[ipp.AttributePrinterState]; len(val) == 1 {
+			if state, ok := (val[0].Value).(int); ok {
+				s.State = printerStates[state]
+			}
+		}
+
+		for _, reason := range a[ipp.AttributePrinterStateReasons] {
+			if r, ok := (reason.Value).(string); ok && r != "none" {
+				s.Reasons = append(s.Reasons, r)
+			}
+		}
+
+		if val := a[ipp.AttributePrinterMakeAndModel]; len(val) == 1 {
+			s.MakeAndModel = (val[0].Value).(string)
+		}
+	}
+
+	return states, nil
+}
+
+// AddOrModify creates or updates the Printer and returns the chosen driver, or returns an error if one occurred.
+// Progress is reported to ctx
+func (c *Client) AddOrModify(ctx context.Context, p *Printer) (*DriverMatch, error) {
 	// skip misconfigured drivers
 	if p.Driver == nil || p.Driver.CUPS == nil {
-		return errors.New("Missing driver configuration")
+		return nil, errors.New("Missing driver configuration")
 	}
-	//find first matching PPD
 	ppds, err := c.GetPPDs()
 	if err != nil {
-		return fmt.Errorf("Unable to get PPDs: %w", err)
+		return nil, fmt.Errorf("Unable to get PPDs: %w", err)
 	}
 
-	ppd := ""
-	var everywhere bool
-	for _, p := range p.DriverName {
-		if name, ok := ppds[p]; ok {
-			ppd = name
-			break
-		} else if p == EverywhereDriver {
-			everywhere = true
-		}
+	match, err := MatchDriver(ppds, p.DriverName, c.DriverPolicy)
+	// use the PPD file instead of falling back to IPP Everywhere
+	upload := p.PPD != nil && c.FetchPPD != nil && (errors.Is(err, ErrNoMatchingDriver) || (err == nil && match.fallback))
+	if upload {
+		match, err = &DriverMatch{Spec: p.PPD.URL, PPD: p.PPD.URL, Reason: "no installed PPDs matched; uploaded PPD file"}, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	progress.Report(ctx, "Using driver %s for printer %s", match, p.ID)
 
-	if ppd == "" {
-		// only create IPP Everywhere printer if no PPDs are found
-		if everywhere {
-			if err := c.CreateIPPEverywhere(p); err != nil {
-				return fmt.Errorf("could not create IPP Everywhere printer: %w", err)
-			}
-		} else {
-			return errors.New("No matching PPDs found")
+	r := ipp.NewRequest(ipp.OperationCupsAddModifyPrinter, rand.Int31())
+	switch {
+	case match.PPD == EverywhereDriver:
+		if err := c.CreateIPPEverywhere(ctx, p); err != nil {
+			return nil, fmt.Errorf("could not create IPP Everywhere printer: %w", err)
 		}
+	case upload:
+		path, err := c.FetchPPD(ctx, p.PPD)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch PPD file: %w", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open PPD file: %w", err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to stat PPD file: %w", err)
+		}
+		r.File, r.FileSize = f, int(info.Size())
+	default:
+		r.OperationAttributes[ipp.AttributePPDName] = match.PPD
 	}
 
-	r := ipp.NewRequest(ipp.OperationCupsAddModifyPrinter, rand.Int31())
 	r.OperationAttributes[ipp.AttributePrinterURI] = c.adapter.GetHttpUri("printers", p.ID)
-	r.OperationAttributes[ipp.AttributeDeviceURI] = fmt.Sprintf(p.URITemplate, p.Hostname)
-	if ppd != "" {
-		r.OperationAttributes[ipp.AttributePPDName] = ppd
-	}
+	r.OperationAttributes[ipp.AttributeDeviceURI] = p.DeviceURI()
 	r.OperationAttributes[ipp.AttributePrinterInfo] = p.GetName()
 	r.OperationAttributes[ipp.AttributePrinterLocation] = p.GetLocation()
 	r.OperationAttributes[ipp.AttributePrinterIsAcceptingJobs] = true
 	r.OperationAttributes[ipp.AttributePrinterState] = ipp.PrinterStateIdle
 	r.OperationAttributes[ipp.AttributePrinterIsTemporary] = false
 	if _, err := c.client.SendRequest(c.adminURL(), r, nil); err != nil {
-		return fmt.Errorf("Unable to add or modify printer: %w", err)
+		return nil, fmt.Errorf("Unable to add or modify printer: %w", err)
 	}
 
 	if len(p.Options) == 0 {
-		return nil
+		return match, nil
 	}
 
 	//use lpadmin to update options
@@ -236,10 +337,10 @@ func (c *Client) AddOrModify(p *Printer) error {
 	}
 	cmd := exec.Command("lpadmin", options...)
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Unable to set printer options: %w", err)
+		return nil, fmt.Errorf("Unable to set printer options: %w", err)
 	}
 
-	return nil
+	return match, nil
 }
 
 var ippEverywhereStrategy = &retry.Strategy{
@@ -257,14 +358,15 @@ var ippEverywhereStrategy = &retry.Strategy{
 	},
 }
 
-// CreateIPPEverywhere creates the Printer as an IPP Everywhere printer or returns an error if one occurred
-func (c *Client) CreateIPPEverywhere(p *Printer) error {
+// CreateIPPEverywhere creates the Printer as an IPP Everywhere printer or returns an error if one occurred.
+// Retries are reported to ctx, and stop if ctx is canceled
+func (c *Client) CreateIPPEverywhere(ctx context.Context, p *Printer) error {
 	// https://github.com/apple/cups/issues/5919
 	// try creating local printer, which is asynchronous
 	r := ipp.NewRequest(ipp.OperationCupsCreateLocalPrinter, rand.Int31())
 	r.OperationAttributes[ipp.AttributePrinterURI] = c.adapter.GetHttpUri("printers", p.ID)
 	r.PrinterAttributes[ipp.AttributePrinterName] = p.ID
-	r.PrinterAttributes[ipp.AttributeDeviceURI] = fmt.Sprintf(p.URITemplate, p.Hostname)
+	r.PrinterAttributes[ipp.AttributeDeviceURI] = p.DeviceURI()
 	r.PrinterAttributes[ipp.AttributePrinterInfo] = p.GetName()
 	r.PrinterAttributes[ipp.AttributePrinterLocation] = p.GetLocation()
 	r.PrinterAttributes[ipp.AttributePrinterIsAcceptingJobs] = true
@@ -278,14 +380,18 @@ func (c *Client) CreateIPPEverywhere(p *Printer) error {
 		return fmt.Errorf("could not create local printer: %w", err)
 	}
 
+	progress.Report(ctx, "Creating IPP Everywhere printer %s", p.ID)
+
 	// get printer PPD to verify printer is created
-	if err := ippEverywhereStrategy.Retry(func() error {
+	if err := ippEverywhereStrategy.RetryNotify(ctx, func() error {
 		r := ipp.NewRequest(ipp.OperationCupsGetPpd, rand.Int31())
 		r.OperationAttributes[ipp.AttributePrinterURI] = c.adapter.GetHttpUri("printers", p.ID)
 		if _, err := c.client.SendRequest(c.adminURL(), r, nil); err != nil {
 			return err
 		}
 		return nil
+	}, func(tries int, err error, wait time.Duration) {
+		progress.Report(ctx, "Waiting for IPP Everywhere printer %s (try %d): retrying in %s: %v", p.ID, tries, wait.Round(time.Millisecond), err)
 	}); err != nil {
 		ippErr := new(ipp.IPPError)
 		if !errors.As(err, ippErr) || ippErr.Status != ipp.StatusErrorNotFound {
@@ -312,6 +418,67 @@ func (c *Client) Delete(p *Printer) error {
 	return nil
 }
 
+// Disable stops the Printer and sets it to reject jobs or returns an error if one occurred
+func (c *Client) Disable(p *Printer) error {
+	r := ipp.NewRequest(ipp.OperationPausePrinter, rand.Int31())
+	r.OperationAttributes[ipp.AttributePrinterURI] = c.adapter.GetHttpUri("printers", p.ID)
+	if _, err := c.client.SendRequest(c.adminURL(), r, nil); err != nil {
+		return fmt.Errorf("Unable to complete IPP request: %w", err)
+	}
+
+	return c.RejectJobs(p)
+}
+
+// RejectJobs sets the Printer to reject new jobs or returns an error if one occurred
+func (c *Client) RejectJobs(p *Printer) error {
+	r := ipp.NewRequest(ipp.OperationCupsRejectJobs, rand.Int31())
+	r.OperationAttributes[ipp.AttributePrinterURI] = c.adapter.GetHttpUri("printers", p.ID)
+	if _, err := c.client.SendRequest(c.adminURL(), r, nil); err != nil {
+		return fmt.Errorf("Unable to complete IPP request: %w", err)
+	}
+	return nil
+}
+
+// ActiveJobs returns the number of pending, held, or processing jobs for the Printer or an error if one occurred
+func (c *Client) ActiveJobs(p *Printer) (int, error) {
+	r := ipp.NewRequest(ipp.OperationGetJobs, rand.Int31())
+	r.OperationAttributes[ipp.AttributePrinterURI] = c.adapter.GetHttpUri("printers", p.ID)
+	r.OperationAttributes[ipp.AttributeWhichJobs] = ipp.JobStateFilterNotCompleted
+	r.OperationAttributes[ipp.AttributeRequestedAttributes] = []string{ipp.AttributeJobID}
+	resp, err := c.client.SendRequest(c.adminURL(), r, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to complete IPP request: %w", err)
+	}
+	return len(resp.JobAttributes), nil
+}
+
+// Drain sets the Printer to reject new jobs and waits for active jobs to complete.
+// ErrActiveJobs is returned if jobs are still active after timeout, or ctx's error if it's canceled first
+func (c *Client) Drain(ctx context.Context, p *Printer, timeout time.Duration) error {
+	if err := c.RejectJobs(p); err != nil {
+		return fmt.Errorf("Unable to reject jobs: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := c.ActiveJobs(p)
+		if err != nil {
+			return fmt.Errorf("Unable to get active jobs: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		if time.Now().Add(DrainPollInterval).After(deadline) {
+			return ErrActiveJobs
+		}
+		select {
+		case <-time.After(DrainPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 // SetDefault sets the Printer as default or returns an error if one occurred
 func (c *Client) SetDefault(p *Printer) error {
 	r := ipp.NewRequest(ipp.OperationCupsSetDefault, rand.Int31())
@@ -325,5 +492,7 @@ func (c *Client) SetDefault(p *Printer) error {
 
 // ClearCache clears the clients PPD cache
 func (c *Client) ClearCache() {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
 	c.cache = nil
 }
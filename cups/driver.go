@@ -0,0 +1,275 @@
+package cups
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Driver spec prefixes. A DriverName entry without a prefix matches a ppd-make-and-model exactly
+const (
+	// DriverPrefixRegex specs are regular expressions matched against ppd-make-and-model
+	DriverPrefixRegex = "regex:"
+	// DriverPrefixGlob specs are glob patterns (see path.Match) matched against ppd-make-and-model
+	DriverPrefixGlob = "glob:"
+	// DriverPrefixPPD specs match ppd-name exactly, e.g. ppd:drv:///hpcups.drv/hp-laserjet_4250.ppd
+	DriverPrefixPPD = "ppd:"
+	// DriverPrefixFuzzy specs match the ppd-make-and-model with the highest normalized similarity score,
+	// if it's at least the DriverPolicy's FuzzyThreshold
+	DriverPrefixFuzzy = "fuzzy:"
+)
+
+// DefaultFuzzyThreshold is the default minimum score of a fuzzy driver match
+const DefaultFuzzyThreshold = 0.5
+
+// Everywhere policies control when IPP Everywhere is chosen for Printers with EverywhereDriver in their DriverName list
+const (
+	// EverywhereFallback chooses IPP Everywhere only if no PPDs match
+	EverywhereFallback = "fallback"
+	// EverywherePrefer chooses IPP Everywhere over any matching PPDs
+	EverywherePrefer = "prefer"
+	// EverywhereOrder chooses IPP Everywhere if it's listed before every spec matching a PPD
+	EverywhereOrder = "order"
+)
+
+// ErrNoMatchingDriver is returned when no DriverName entry matches an installed PPD
+var ErrNoMatchingDriver = errors.New("No matching PPDs found")
+
+// DriverPolicy controls how a driver is chosen when multiple drivers match
+type DriverPolicy struct {
+	// Everywhere is EverywhereFallback, EverywherePrefer, or EverywhereOrder
+	Everywhere string
+	// Families are case-insensitive substrings of ppd-name or ppd-make-and-model, e.g. hpcups or foomatic.
+	// PPDs matching earlier families are preferred, then PPDs matching no family. Ties are broken by DriverName order
+	Families []string
+	// FuzzyThreshold is the minimum score of a fuzzy driver match
+	FuzzyThreshold float64
+}
+
+// DefaultDriverPolicy returns the default DriverPolicy, which chooses the first matching PPD
+// and IPP Everywhere only if no PPDs match
+func DefaultDriverPolicy() *DriverPolicy {
+	return &DriverPolicy{Everywhere: EverywhereFallback, FuzzyThreshold: DefaultFuzzyThreshold}
+}
+
+// DriverMatch describes the driver chosen for a Printer
+type DriverMatch struct {
+	// Spec is the DriverName entry that matched
+	Spec string `json:"spec"`
+	// PPD is the ppd-name of the chosen PPD, the URL of an uploaded PPDFile, or EverywhereDriver
+	PPD          string `json:"ppd"`
+	MakeAndModel string `json:"make_and_model,omitempty"`
+	// Reason describes why the driver was chosen
+	Reason string `json:"reason"`
+	// Score is the similarity score of a fuzzy match
+	Score float64 `json:"score,omitempty"`
+	// fallback is true if IPP Everywhere was chosen because no PPDs matched
+	fallback bool
+}
+
+func (m *DriverMatch) String() string {
+	if m.PPD == EverywhereDriver {
+		return fmt.Sprintf("IPP Everywhere: %s", m.Reason)
+	}
+	return fmt.Sprintf("%s (%s): %s", m.MakeAndModel, m.PPD, m.Reason)
+}
+
+// candidate is a PPD matched by a DriverName entry
+type candidate struct {
+	// spec is the index of the DriverName entry
+	spec int
+	// rank is the index of the preferred family the PPD belongs to
+	rank  int
+	match *DriverMatch
+	// matches is the number of PPDs matched by the DriverName entry
+	matches int
+}
+
+// MatchDriver returns the driver chosen by policy from the PPDs matched by specs, with ppds being a mapping of make-and-model to name.
+// Invalid specs are logged and skipped. ErrNoMatchingDriver is returned if no driver matches
+func MatchDriver(ppds map[string]string, specs []string, policy *DriverPolicy) (*DriverMatch, error) {
+	// sort for deterministic results when a pattern matches multiple PPDs
+	models := make([]string, 0, len(ppds))
+	for model := range ppds {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	everywhere := -1
+	var candidates []*candidate
+	var invalid []string
+	for i, spec := range specs {
+		if spec == EverywhereDriver {
+			if everywhere == -1 {
+				everywhere = i
+			}
+			continue
+		}
+		matches, err := matchSpec(ppds, models, spec, policy.FuzzyThreshold)
+		if err != nil {
+			log.Printf("WARN: Skipped %v\n", err)
+			invalid = append(invalid, spec)
+			continue
+		}
+		for _, m := range matches {
+			candidates = append(candidates, &candidate{spec: i, rank: policy.familyRank(m), match: m, matches: len(matches)})
+		}
+	}
+
+	// candidates are in DriverName order, so the first of equally ranked candidates wins
+	var best *candidate
+	for _, c := range candidates {
+		if best == nil || c.rank < best.rank {
+			best = c
+		}
+	}
+
+	if everywhere != -1 {
+		m := &DriverMatch{Spec: EverywhereDriver, PPD: EverywhereDriver}
+		switch {
+		case best == nil:
+			m.Reason, m.fallback = "no PPDs matched", true
+			return m, nil
+		case policy.Everywhere == EverywherePrefer:
+			m.Reason = fmt.Sprintf("preferred over %d matching PPDs by policy", len(candidates))
+			return m, nil
+		case policy.Everywhere == EverywhereOrder && everywhere < candidates[0].spec:
+			m.Reason = "listed before matching PPDs"
+			return m, nil
+		}
+	}
+
+	if best == nil {
+		if len(invalid) > 0 {
+			return nil, fmt.Errorf("%w; invalid driver specs: %s", ErrNoMatchingDriver, strings.Join(invalid, ", "))
+		}
+		return nil, ErrNoMatchingDriver
+	}
+
+	m := best.match
+	if best.rank < len(policy.Families) {
+		m.Reason += fmt.Sprintf("; preferred driver family %s", policy.Families[best.rank])
+	} else if best.matches > 1 {
+		m.Reason += fmt.Sprintf(" (first of %d matches)", best.matches)
+	}
+	return m, nil
+}
+
+// familyRank returns the index of the first family in p.Families m belongs to, or len(p.Families) if none
+func (p *DriverPolicy) familyRank(m *DriverMatch) int {
+	s := strings.ToLower(m.PPD + " " + m.MakeAndModel)
+	for i, f := range p.Families {
+		if strings.Contains(s, strings.ToLower(f)) {
+			return i
+		}
+	}
+	return len(p.Families)
+}
+
+// matchSpec returns the drivers matching spec, best first, or an error if spec is invalid
+func matchSpec(ppds map[string]string, models []string, spec string, threshold float64) ([]*DriverMatch, error) {
+	switch {
+	case strings.HasPrefix(spec, DriverPrefixRegex):
+		re, err := regexp.Compile(strings.TrimPrefix(spec, DriverPrefixRegex))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid driver spec %s: %w", spec, err)
+		}
+		return matchAll(ppds, models, spec, "regular expression", re.MatchString), nil
+	case strings.HasPrefix(spec, DriverPrefixGlob):
+		pattern := strings.TrimPrefix(spec, DriverPrefixGlob)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid driver spec %s: %w", spec, err)
+		}
+		return matchAll(ppds, models, spec, "glob pattern", func(model string) bool {
+			ok, _ := path.Match(pattern, model)
+			return ok
+		}), nil
+	case strings.HasPrefix(spec, DriverPrefixPPD):
+		name := strings.TrimPrefix(spec, DriverPrefixPPD)
+		for _, model := range models {
+			if ppds[model] == name {
+				return []*DriverMatch{{Spec: spec, PPD: name, MakeAndModel: model, Reason: "matched ppd-name"}}, nil
+			}
+		}
+		return nil, nil
+	case strings.HasPrefix(spec, DriverPrefixFuzzy):
+		return matchFuzzy(ppds, models, spec, threshold), nil
+	}
+
+	if name, ok := ppds[spec]; ok {
+		return []*DriverMatch{{Spec: spec, PPD: name, MakeAndModel: spec, Reason: "matched make and model exactly"}}, nil
+	}
+	return nil, nil
+}
+
+// matchAll returns the drivers for the sorted models matching match
+func matchAll(ppds map[string]string, models []string, spec, kind string, match func(model string) bool) []*DriverMatch {
+	var matches []*DriverMatch
+	for _, model := range models {
+		if match(model) {
+			matches = append(matches, &DriverMatch{Spec: spec, PPD: ppds[model], MakeAndModel: model, Reason: "matched " + kind})
+		}
+	}
+	return matches
+}
+
+// matchFuzzy returns the drivers for the models scoring at least threshold, sorted by highest score, then shortest model
+func matchFuzzy(ppds map[string]string, models []string, spec string, threshold float64) []*DriverMatch {
+	query := tokenize(strings.TrimPrefix(spec, DriverPrefixFuzzy))
+	var matches []*DriverMatch
+	for _, model := range models {
+		score := fuzzyScore(query, tokenize(model))
+		if score == 0 || score < threshold {
+			continue
+		}
+		matches = append(matches, &DriverMatch{
+			Spec:         spec,
+			PPD:          ppds[model],
+			MakeAndModel: model,
+			Reason:       fmt.Sprintf("fuzzy match with score %.2f (minimum %.2f)", score, threshold),
+			Score:        score,
+		})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return len(matches[i].MakeAndModel) < len(matches[j].MakeAndModel)
+	})
+	return matches
+}
+
+// tokenize returns the set of lowercased alphanumeric words in s
+func tokenize(s string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, t := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		tokens[t] = true
+	}
+	return tokens
+}
+
+// fuzzyScore returns the Dice coefficient of the query and model tokens, from 0 to 1.
+// The score is 0 if a query token containing a digit (e.g. a model number) is missing from model
+func fuzzyScore(query, model map[string]bool) float64 {
+	if len(query) == 0 || len(model) == 0 {
+		return 0
+	}
+	var common int
+	for t := range query {
+		if model[t] {
+			common++
+			continue
+		}
+		if strings.IndexFunc(t, unicode.IsDigit) != -1 {
+			return 0
+		}
+	}
+	return 2 * float64(common) / float64(len(query)+len(model))
+}
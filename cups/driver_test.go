@@ -0,0 +1,166 @@
+package cups
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+var testPPDs = map[string]string{
+	"HP LaserJet 4250, hpcups 3.21":                      "drv:///hpcups.drv/hp-laserjet_4250.ppd",
+	"HP LaserJet 4250 Foomatic/Postscript (recommended)": "foomatic-db-compressed-ppds:0/ppd/foomatic-ppd/HP-LaserJet_4250-Postscript.ppd",
+	"HP LaserJet 4200 Foomatic/Postscript":               "foomatic-db-compressed-ppds:0/ppd/foomatic-ppd/HP-LaserJet_4200-Postscript.ppd",
+	"Generic PostScript Printer Foomatic/Postscript":     "foomatic-db-compressed-ppds:0/ppd/foomatic-ppd/Generic-PostScript_Printer-Postscript.ppd",
+	"Xerox WorkCentre 7855 PS":                           "xrx7855.ppd",
+}
+
+func TestMatchDriver(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		specs     []string
+		threshold float64
+		ppd       string
+		reason    string
+		noMatch   bool
+		// invalid is true if the error must name an invalid spec
+		invalid bool
+	}{
+		{name: "exact", specs: []string{"Xerox WorkCentre 7855 PS"}, ppd: "xrx7855.ppd", reason: "matched make and model exactly"},
+		{name: "exact is case sensitive", specs: []string{"xerox workcentre 7855 ps"}, noMatch: true},
+		{name: "first matching spec", specs: []string{"Missing Printer", "HP LaserJet 4250, hpcups 3.21", "Xerox WorkCentre 7855 PS"}, ppd: "drv:///hpcups.drv/hp-laserjet_4250.ppd"},
+		{name: "no specs", noMatch: true},
+		{name: "regex", specs: []string{"regex:^Xerox .* 7855"}, ppd: "xrx7855.ppd", reason: "matched regular expression"},
+		{name: "regex first sorted match", specs: []string{"regex:^HP LaserJet 4250"}, ppd: "foomatic-db-compressed-ppds:0/ppd/foomatic-ppd/HP-LaserJet_4250-Postscript.ppd", reason: "(first of 2 matches)"},
+		{name: "regex no match", specs: []string{"regex:^Canon"}, noMatch: true},
+		{name: "invalid regex", specs: []string{"regex:("}, noMatch: true, invalid: true},
+		{name: "invalid regex skipped", specs: []string{"regex:(", "regex:^Xerox"}, ppd: "xrx7855.ppd", reason: "matched regular expression"},
+		{name: "glob", specs: []string{"glob:*hpcups*"}, ppd: "drv:///hpcups.drv/hp-laserjet_4250.ppd", reason: "matched glob pattern"},
+		{name: "glob matches whole model", specs: []string{"glob:HP LaserJet 42?0"}, noMatch: true},
+		{name: "invalid glob", specs: []string{"glob:["}, noMatch: true, invalid: true},
+		{name: "invalid glob skipped", specs: []string{"glob:[", "Xerox WorkCentre 7855 PS"}, ppd: "xrx7855.ppd", reason: "matched make and model exactly"},
+		{name: "ppd", specs: []string{"ppd:xrx7855.ppd"}, ppd: "xrx7855.ppd", reason: "matched ppd-name"},
+		{name: "ppd no match", specs: []string{"ppd:Xerox WorkCentre 7855 PS"}, noMatch: true},
+		{name: "fuzzy", specs: []string{"fuzzy:xerox workcentre 7855"}, ppd: "xrx7855.ppd", reason: "fuzzy match with score 0.86 (minimum 0.50)"},
+		{name: "fuzzy ties prefer shorter model", specs: []string{"fuzzy:HP LaserJet 4250"}, ppd: "drv:///hpcups.drv/hp-laserjet_4250.ppd", reason: "(first of 2 matches)"},
+		{name: "fuzzy higher score wins", specs: []string{"fuzzy:hp laserjet 4250 postscript"}, ppd: "foomatic-db-compressed-ppds:0/ppd/foomatic-ppd/HP-LaserJet_4250-Postscript.ppd"},
+		{name: "fuzzy model number must match", specs: []string{"fuzzy:xerox workcentre 7845"}, noMatch: true},
+		{name: "fuzzy at threshold", specs: []string{"fuzzy:HP LaserJet 4250"}, threshold: 2.0 / 3, ppd: "drv:///hpcups.drv/hp-laserjet_4250.ppd"},
+		{name: "fuzzy below threshold", specs: []string{"fuzzy:HP LaserJet 4250"}, threshold: 0.7, noMatch: true},
+		{name: "fuzzy empty query", specs: []string{"fuzzy:"}, noMatch: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			policy := DefaultDriverPolicy()
+			if test.threshold != 0 {
+				policy.FuzzyThreshold = test.threshold
+			}
+
+			m, err := MatchDriver(testPPDs, test.specs, policy)
+			if test.noMatch {
+				if !errors.Is(err, ErrNoMatchingDriver) {
+					t.Fatalf("expected ErrNoMatchingDriver, got %v, %v", m, err)
+				}
+				if test.invalid && !strings.Contains(err.Error(), test.specs[0]) {
+					t.Errorf("expected error naming invalid spec %s, got %v", test.specs[0], err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if m.PPD != test.ppd {
+				t.Errorf("expected PPD %s, got %s", test.ppd, m.PPD)
+			}
+			if testPPDs[m.MakeAndModel] != m.PPD {
+				t.Errorf("make and model %q doesn't match PPD %s", m.MakeAndModel, m.PPD)
+			}
+			if !strings.Contains(m.Reason, test.reason) {
+				t.Errorf("expected reason containing %q, got %q", test.reason, m.Reason)
+			}
+		})
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	for _, test := range []struct {
+		query, model string
+		score        float64
+	}{
+		{"", "HP LaserJet 4250", 0},
+		{"HP LaserJet 4250", "", 0},
+		{"HP LaserJet 4250", "hp laserjet 4250", 1},
+		{"HP LaserJet 4250", "HP LaserJet 4250, hpcups 3.21", 2.0 / 3},
+		{"HP LaserJet Pro", "HP LaserJet", 0.8},
+		{"HP LaserJet 4250", "HP LaserJet 4200", 0},
+		{"Canon", "HP LaserJet 4250", 0},
+	} {
+		score := fuzzyScore(tokenize(test.query), tokenize(test.model))
+		if math.Abs(score-test.score) > 1e-9 {
+			t.Errorf("fuzzyScore(%q, %q): expected %.4f, got %.4f", test.query, test.model, test.score, score)
+		}
+	}
+}
+
+func TestMatchDriverPolicy(t *testing.T) {
+	const (
+		hpcups   = "drv:///hpcups.drv/hp-laserjet_4250.ppd"
+		foomatic = "foomatic-db-compressed-ppds:0/ppd/foomatic-ppd/HP-LaserJet_4250-Postscript.ppd"
+		xerox    = "xrx7855.ppd"
+	)
+	for _, test := range []struct {
+		name       string
+		specs      []string
+		everywhere string
+		families   []string
+		ppd        string
+		reason     string
+		fallback   bool
+		noMatch    bool
+	}{
+		{name: "family preferred over spec order", specs: []string{"glob:*hpcups*", "HP LaserJet 4250 Foomatic/Postscript (recommended)"}, families: []string{"foomatic", "hpcups"}, ppd: foomatic, reason: "preferred driver family foomatic"},
+		{name: "earlier family ranks higher", specs: []string{"regex:^HP LaserJet 4250"}, families: []string{"hpcups", "foomatic"}, ppd: hpcups, reason: "preferred driver family hpcups"},
+		{name: "family matches case insensitively", specs: []string{"regex:^HP LaserJet 4250"}, families: []string{"HPCUPS"}, ppd: hpcups},
+		{name: "family matches ppd-name", specs: []string{"Xerox WorkCentre 7855 PS", "glob:*hpcups*"}, families: []string{"xrx"}, ppd: xerox, reason: "preferred driver family xrx"},
+		{name: "family ranked over unmatched", specs: []string{"Xerox WorkCentre 7855 PS", "glob:*hpcups*"}, families: []string{"hpcups"}, ppd: hpcups},
+		{name: "no family uses spec order", specs: []string{"Xerox WorkCentre 7855 PS", "glob:*hpcups*"}, families: []string{"gutenprint"}, ppd: xerox, reason: "matched make and model exactly"},
+		{name: "fallback without matches", specs: []string{"Missing Printer", EverywhereDriver}, everywhere: EverywhereFallback, ppd: EverywhereDriver, reason: "no PPDs matched", fallback: true},
+		{name: "fallback with matches", specs: []string{EverywhereDriver, "Xerox WorkCentre 7855 PS"}, everywhere: EverywhereFallback, ppd: xerox},
+		{name: "prefer with matches", specs: []string{"Xerox WorkCentre 7855 PS", EverywhereDriver}, everywhere: EverywherePrefer, ppd: EverywhereDriver, reason: "preferred over 1 matching PPDs"},
+		{name: "prefer without matches", specs: []string{"Missing Printer", EverywhereDriver}, everywhere: EverywherePrefer, ppd: EverywhereDriver, fallback: true},
+		{name: "prefer requires everywhere spec", specs: []string{"Xerox WorkCentre 7855 PS"}, everywhere: EverywherePrefer, ppd: xerox},
+		{name: "order listed first", specs: []string{"Missing Printer", EverywhereDriver, "Xerox WorkCentre 7855 PS"}, everywhere: EverywhereOrder, ppd: EverywhereDriver, reason: "listed before matching PPDs"},
+		{name: "order listed after", specs: []string{"Xerox WorkCentre 7855 PS", EverywhereDriver}, everywhere: EverywhereOrder, ppd: xerox},
+		{name: "order without matches", specs: []string{"Missing Printer", EverywhereDriver}, everywhere: EverywhereOrder, ppd: EverywhereDriver, fallback: true},
+		{name: "no everywhere spec", specs: []string{"Missing Printer"}, everywhere: EverywherePrefer, noMatch: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			policy := DefaultDriverPolicy()
+			if test.everywhere != "" {
+				policy.Everywhere = test.everywhere
+			}
+			policy.Families = test.families
+
+			m, err := MatchDriver(testPPDs, test.specs, policy)
+			if test.noMatch {
+				if !errors.Is(err, ErrNoMatchingDriver) {
+					t.Fatalf("expected ErrNoMatchingDriver, got %v, %v", m, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if m.PPD != test.ppd {
+				t.Errorf("expected PPD %s, got %s", test.ppd, m.PPD)
+			}
+			if !strings.Contains(m.Reason, test.reason) {
+				t.Errorf("expected reason containing %q, got %q", test.reason, m.Reason)
+			}
+			if m.fallback != test.fallback {
+				t.Errorf("expected fallback %v, got %v", test.fallback, m.fallback)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package cups
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultPorts maps device URI schemes to the port used when none is given
+var defaultPorts = map[string]int{
+	"ipp":    631,
+	"ipps":   631,
+	"http":   80,
+	"https":  443,
+	"socket": 9100,
+	"lpd":    515,
+}
+
+// DeviceURI is a parsed CUPS device URI
+type DeviceURI struct {
+	Scheme string
+	Host   string
+	Port   int
+	Path   string
+	// DNSSDName is the service instance name for dnssd:// URIs, or empty otherwise
+	DNSSDName string
+}
+
+// ParseDeviceURI parses the given device URI or returns an error if one occurred
+func ParseDeviceURI(uri string) (*DeviceURI, error) {
+	if strings.HasPrefix(strings.ToLower(uri), "dnssd://") {
+		return parseDNSSDURI(uri)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse URI: %w", err)
+	}
+
+	d := &DeviceURI{Scheme: strings.ToLower(u.Scheme), Path: u.Path}
+
+	d.Host = normalizeHost(u.Hostname())
+	if d.Host == "" {
+		return nil, fmt.Errorf("Missing host in URI: %s", uri)
+	}
+
+	if port := u.Port(); port != "" {
+		if d.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("Unable to parse port %s: %w", port, err)
+		}
+	} else {
+		d.Port = defaultPorts[d.Scheme]
+	}
+
+	return d, nil
+}
+
+// parseDNSSDURI parses a dnssd:// URI, e.g. dnssd://Printer%20Name._ipp._tcp.local./?uuid=...
+// These are parsed manually since net/url doesn't allow escaped spaces in hosts
+func parseDNSSDURI(uri string) (*DeviceURI, error) {
+	rest := uri[len("dnssd://"):]
+	host, path := rest, ""
+	if idx := strings.IndexAny(rest, "/?"); idx != -1 {
+		host, path = rest[:idx], rest[idx:]
+	}
+	if idx := strings.IndexByte(path, '?'); idx != -1 {
+		path = path[:idx]
+	}
+
+	name, err := url.PathUnescape(host)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse URI: %w", err)
+	}
+	if idx := strings.Index(name, "._"); idx != -1 {
+		name = name[:idx]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Missing service name in URI: %s", uri)
+	}
+
+	return &DeviceURI{Scheme: "dnssd", Path: path, DNSSDName: strings.ToLower(name)}, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// cleanPath returns p with redundant and trailing slashes removed, with an empty path treated as "/"
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// URIMatcher matches DeviceURIs by host, port, and path, optionally resolving hosts to IPs
+type URIMatcher struct {
+	Resolve bool
+	ips     map[string][]net.IP
+}
+
+// NewURIMatcher returns a new URIMatcher. If resolve is true, hosts will be compared by resolved IP addresses as well
+func NewURIMatcher(resolve bool) *URIMatcher {
+	return &URIMatcher{Resolve: resolve, ips: make(map[string][]net.IP)}
+}
+
+func (m *URIMatcher) lookup(host string) []net.IP {
+	if ips, ok := m.ips[host]; ok {
+		return ips
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if resolved, err := net.LookupIP(host); err == nil {
+		ips = resolved
+	}
+
+	m.ips[host] = ips
+	return ips
+}
+
+// Match returns true if the given DeviceURIs point to the same printer
+func (m *URIMatcher) Match(a, b *DeviceURI) bool {
+	if a.DNSSDName != "" || b.DNSSDName != "" {
+		return a.DNSSDName != "" && a.DNSSDName == b.DNSSDName
+	}
+
+	// print servers expose different printers on different ports and paths
+	if a.Port != b.Port || cleanPath(a.Path) != cleanPath(b.Path) {
+		return false
+	}
+
+	if a.Host == b.Host {
+		return true
+	}
+
+	if !m.Resolve {
+		return false
+	}
+
+	for _, ipA := range m.lookup(a.Host) {
+		for _, ipB := range m.lookup(b.Host) {
+			if ipA.Equal(ipB) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package cups
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceURI(t *testing.T) {
+	for _, test := range []struct {
+		uri    string
+		parsed *DeviceURI
+		err    bool
+	}{
+		{"ipp://Printer1.Example.com./ipp/print", &DeviceURI{Scheme: "ipp", Host: "printer1.example.com", Port: 631, Path: "/ipp/print"}, false},
+		{"IPPS://printer1.example.com:8631/printers/lab", &DeviceURI{Scheme: "ipps", Host: "printer1.example.com", Port: 8631, Path: "/printers/lab"}, false},
+		{"socket://10.0.0.5", &DeviceURI{Scheme: "socket", Host: "10.0.0.5", Port: 9100}, false},
+		{"socket://10.0.0.5:9101", &DeviceURI{Scheme: "socket", Host: "10.0.0.5", Port: 9101}, false},
+		{"lpd://printer1/queue", &DeviceURI{Scheme: "lpd", Host: "printer1", Port: 515, Path: "/queue"}, false},
+		{"https://[fe80::1]/ipp", &DeviceURI{Scheme: "https", Host: "fe80::1", Port: 443, Path: "/ipp"}, false},
+		{"dnssd://Lab%20Printer._ipp._tcp.local./?uuid=1234", &DeviceURI{Scheme: "dnssd", Path: "/", DNSSDName: "lab printer"}, false},
+		{"usb://HP/LaserJet?serial=1", &DeviceURI{Scheme: "usb", Host: "hp", Path: "/LaserJet"}, false},
+		{"dnssd:///?uuid=1234", nil, true},
+		{"file:/dev/null", nil, true},
+		{"ipp://printer1:abc/ipp", nil, true},
+		{"ipp://%zz", nil, true},
+	} {
+		parsed, err := ParseDeviceURI(test.uri)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseDeviceURI(%q): expected error, got %+v", test.uri, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDeviceURI(%q): unexpected error: %v", test.uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, test.parsed) {
+			t.Errorf("ParseDeviceURI(%q): expected %+v, got %+v", test.uri, test.parsed, parsed)
+		}
+	}
+}
+
+func TestURIMatcherMatch(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		match bool
+	}{
+		{"ipp://printer1.example.com/ipp/print", "ipp://PRINTER1.example.com./ipp/print", true},
+		{"ipp://printer1.example.com/ipp/print", "ipp://printer1.example.com:631/ipp//print/", true},
+		{"ipp://printer1.example.com/ipp/print", "ipps://printer1.example.com/ipp/print", true},
+		{"socket://printer1.example.com", "socket://printer1.example.com/", true},
+		{"ipp://printer1.example.com/ipp/print", "ipp://printer10.example.com/ipp/print", false},
+		{"ipp://printer1.example.com/printers/a", "ipp://printer1.example.com/printers/b", false},
+		{"lpd://printer1.example.com/a", "lpd://printer1.example.com/A", false},
+		{"socket://printer1.example.com:9100", "socket://printer1.example.com:9101", false},
+		{"ipp://printer1.example.com:9100/", "socket://printer1.example.com", true},
+		{"ipp://printer1.example.com/ipp/print", "socket://printer1.example.com", false},
+		{"ipp://printer1.example.com/ipp/print", "https://printer1.example.com/ipp/print", false},
+		{"dnssd://Lab%20Printer._ipp._tcp.local./?uuid=1", "dnssd://lab%20printer._ipps._tcp.local./?uuid=2", true},
+		{"dnssd://Lab%20Printer._ipp._tcp.local./", "ipp://lab-printer.local/ipp/print", false},
+		{"ipp://10.0.0.5/ipp/print", "ipp://10.0.0.6/ipp/print", false},
+	} {
+		a, err := ParseDeviceURI(test.a)
+		if err != nil {
+			t.Fatalf("ParseDeviceURI(%q): unexpected error: %v", test.a, err)
+		}
+		b, err := ParseDeviceURI(test.b)
+		if err != nil {
+			t.Fatalf("ParseDeviceURI(%q): unexpected error: %v", test.b, err)
+		}
+
+		m := NewURIMatcher(false)
+		if match := m.Match(a, b); match != test.match {
+			t.Errorf("Match(%q, %q): expected %v, got %v", test.a, test.b, test.match, match)
+		}
+		if match := m.Match(b, a); match != test.match {
+			t.Errorf("Match(%q, %q): expected %v, got %v", test.b, test.a, test.match, match)
+		}
+	}
+}
+
+func TestURIMatcherResolve(t *testing.T) {
+	a, err := ParseDeviceURI("ipp://printer1.example.com/ipp/print")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseDeviceURI("ipp://10.0.0.5/ipp/print")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewURIMatcher(true)
+	// seed the lookup cache so the test doesn't depend on DNS
+	m.ips["printer1.example.com"] = m.lookup("10.0.0.5")
+	if !m.Match(a, b) {
+		t.Error("expected resolved hosts to match")
+	}
+
+	if NewURIMatcher(false).Match(a, b) {
+		t.Error("expected unresolved hosts not to match")
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/korylprince/printer-manager-cups/cache"
+	"github.com/korylprince/printer-manager-cups/control"
+	"github.com/korylprince/printer-manager-cups/cups"
+	"github.com/korylprince/printer-manager-cups/events"
+	"github.com/korylprince/printer-manager-cups/progress"
+)
+
+// SyncStallTimeout is how long a sync may run without reporting progress before watchdog notifications stop,
+// so systemd restarts a hung sync
+const SyncStallTimeout = 10 * time.Minute
+
+type syncResult struct {
+	report *SyncReport
+	err    error
+}
+
+type syncRequest struct {
+	usernames []string
+	progress  progress.Func
+	result    chan *syncResult
+}
+
+// Daemon coordinates syncs and control commands.
+// Syncs are run by a single coordinator goroutine, with concurrent requests coalesced into one sync.
+// Commands that modify CUPS or the cache are serialized with syncs; read-only commands run concurrently
+type Daemon struct {
+	configPath string
+	config     *Config
+	configMu   sync.RWMutex
+
+	client *cups.Client
+	store  cache.Store
+	events *events.Broker
+
+	// mu serializes operations that modify CUPS or the cache
+	mu sync.Mutex
+
+	started  time.Time
+	statusMu sync.Mutex
+	syncing  bool
+	// lastProgress is when the running sync started or last reported progress
+	lastProgress time.Time
+	lastSync     time.Time
+	lastDuration time.Duration
+	lastReport   *SyncReport
+	lastErr      error
+	nextSync     time.Time
+	// apiPrinters are the printers returned by the API in the last successful sync
+	apiPrinters []*cups.Printer
+
+	// userSyncs maps usernames to the time of their last self-service sync
+	userSyncs   map[string]time.Time
+	userSyncsMu sync.Mutex
+
+	syncs chan *syncRequest
+	// reloaded signals Run to reschedule the next sync with the reloaded SyncInterval
+	reloaded chan struct{}
+	watchdog <-chan time.Time
+	notify   func(state string)
+	done     chan struct{}
+}
+
+// NewDaemon returns a new Daemon
+func NewDaemon(configPath string, config *Config, client *cups.Client, store cache.Store) *Daemon {
+	return &Daemon{
+		configPath: configPath,
+		config:     config,
+		client:     client,
+		store:      store,
+		events:     events.NewBroker(),
+		started:    time.Now(),
+		userSyncs:  make(map[string]time.Time),
+		syncs:      make(chan *syncRequest),
+		reloaded:   make(chan struct{}, 1),
+		notify:     func(string) {},
+		done:       make(chan struct{}),
+	}
+}
+
+// Config returns the current Config. The returned Config must not be modified
+func (d *Daemon) Config() *Config {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	return d.config
+}
+
+// Reload reloads the reloadable Config fields from the environment and config file, or returns an error if one occurred
+func (d *Daemon) Reload() (string, error) {
+	n, err := LoadConfig(d.configPath)
+	if err != nil {
+		return "", err
+	}
+
+	d.configMu.Lock()
+	c := *d.config
+	restart := c.Reload(n)
+	d.config = &c
+	d.configMu.Unlock()
+
+	// Run picks up the signal after a running sync
+	select {
+	case d.reloaded <- struct{}{}:
+	default:
+	}
+
+	resp := "Configuration reloaded"
+	if len(restart) > 0 {
+		log.Println("WARN: Changed configuration requires restart:", strings.Join(restart, ", "))
+		resp += fmt.Sprintf("; restart required for: %s", strings.Join(restart, ", "))
+	}
+	log.Println("INFO: Configuration reloaded")
+
+	return resp, nil
+}
+
+// Sync requests a sync including usernames and waits for it to complete, sending progress to f if it's not nil.
+// f is called while the sync holds the daemon lock, so it must not block.
+// If a sync is already running, the request is coalesced with other waiting requests into the next sync
+func (d *Daemon) Sync(ctx context.Context, usernames []string, f progress.Func) (*SyncReport, error) {
+	req := &syncRequest{usernames: usernames, progress: f, result: make(chan *syncResult, 1)}
+	select {
+	case d.syncs <- req:
+	case <-d.done:
+		return nil, context.Canceled
+	}
+	res := <-req.result
+	return res.report, res.err
+}
+
+// SyncUser runs a sync of only username's printers, or returns an error if one occurred.
+// Each user may sync at most once per UserSyncInterval
+func (d *Daemon) SyncUser(ctx context.Context, username string) (*SyncReport, error) {
+	d.userSyncsMu.Lock()
+	if last, ok := d.userSyncs[username]; ok {
+		if wait := d.Config().UserSyncInterval - time.Since(last); wait > 0 {
+			d.userSyncsMu.Unlock()
+			return nil, control.Errorf(control.ErrorCodeRateLimited, "%s synced recently; try again in %s", username, wait.Round(time.Second))
+		}
+	}
+	d.userSyncs[username] = time.Now()
+	d.userSyncsMu.Unlock()
+
+	d.mu.Lock()
+	report, err := SyncUser(ctx, d.Config(), d.client, d.store, username)
+	d.mu.Unlock()
+
+	// the interval starts when the sync finishes
+	d.userSyncsMu.Lock()
+	d.userSyncs[username] = time.Now()
+	d.userSyncsMu.Unlock()
+
+	return report, err
+}
+
+// Run runs periodic and requested syncs until ctx is canceled
+func (d *Daemon) Run(ctx context.Context) {
+	defer close(d.done)
+	ctx = events.WithBroker(ctx, d.events)
+
+	go d.pingWatchdog(ctx)
+
+	t := time.NewTimer(0)
+	ready := false
+
+	for {
+		var reqs []*syncRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-d.syncs:
+			log.Println("INFO: Sync command received. Running sync")
+			reqs = append(reqs, req)
+		case <-d.reloaded:
+			d.reschedule(t)
+			continue
+		case <-t.C:
+		}
+
+		// coalesce waiting requests
+	coalesce:
+		for {
+			select {
+			case req := <-d.syncs:
+				reqs = append(reqs, req)
+			default:
+				break coalesce
+			}
+		}
+
+		var usernames []string
+		for _, req := range reqs {
+			usernames = append(usernames, req.usernames...)
+		}
+
+		d.mu.Lock()
+		start := time.Now()
+		d.statusMu.Lock()
+		d.syncing = true
+		d.lastProgress = start
+		d.statusMu.Unlock()
+
+		// send progress to every waiting request. Progress funcs don't block, so a slow client can't stall the sync
+		syncCtx := progress.WithFunc(ctx, func(msg string) {
+			d.statusMu.Lock()
+			d.lastProgress = time.Now()
+			d.statusMu.Unlock()
+			for _, req := range reqs {
+				if req.progress != nil {
+					req.progress(msg)
+				}
+			}
+		})
+		report, err := Sync(syncCtx, d.Config(), d.client, d.store, usernames)
+		d.mu.Unlock()
+
+		interval := d.Config().SyncInterval
+		d.statusMu.Lock()
+		d.syncing = false
+		d.lastSync = start
+		d.lastDuration = time.Since(start).Round(time.Millisecond)
+		d.lastReport, d.lastErr = report, err
+		d.nextSync = time.Now().Add(interval)
+		if report != nil && report.Printers != nil {
+			d.apiPrinters = report.Printers
+		}
+		d.statusMu.Unlock()
+
+		if err != nil {
+			log.Println("WARN: Sync failed:", err)
+		}
+		d.notify("STATUS=" + syncStatus(start, report, err))
+		if !ready {
+			// ready once the control socket is up and the first sync has run
+			d.notify("READY=1")
+			ready = true
+		}
+
+		for _, req := range reqs {
+			req.result <- &syncResult{report: report, err: err}
+		}
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(interval)
+	}
+}
+
+// reschedule resets t to fire SyncInterval after the last sync finished, or immediately if that's passed
+func (d *Daemon) reschedule(t *time.Timer) {
+	interval := d.Config().SyncInterval
+	d.statusMu.Lock()
+	next := time.Now()
+	if !d.lastSync.IsZero() {
+		next = d.lastSync.Add(d.lastDuration + interval)
+	}
+	d.nextSync = next
+	d.statusMu.Unlock()
+
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(time.Until(next))
+}
+
+// pingWatchdog notifies the systemd watchdog until ctx is canceled.
+// Notifications stop while the running sync is stalled, so systemd restarts the daemon
+func (d *Daemon) pingWatchdog(ctx context.Context) {
+	if d.watchdog == nil {
+		return
+	}
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.watchdog:
+			if d.syncStalled() {
+				if !stalled {
+					log.Printf("WARN: Sync hasn't reported progress in %s; stopping watchdog notifications\n", SyncStallTimeout)
+					stalled = true
+				}
+				continue
+			}
+			stalled = false
+			d.notify("WATCHDOG=1")
+		}
+	}
+}
+
+// syncStalled returns true if a sync is running and hasn't reported progress within SyncStallTimeout
+func (d *Daemon) syncStalled() bool {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+	return d.syncing && time.Since(d.lastProgress) > SyncStallTimeout
+}
+
+// Wait waits for Run to return and any running commands to finish
+func (d *Daemon) Wait() {
+	<-d.done
+	d.mu.Lock()
+}
+
+// Register registers the control handlers with l. Handlers are canceled with ctx
+func (d *Daemon) Register(ctx context.Context, l *control.Listener) {
+	ctx = events.WithBroker(ctx, d.events)
+	l.Version = Version
+	l.Authorize = d.authorize
+
+	l.Register(control.PacketTypeSync, func(p *control.Packet) (interface{}, error) {
+		users := make([]string, 0)
+		if err := p.Decode(&users); err != nil {
+			log.Println("WARN: Unable to unmarshal users:", err)
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal users: %v", err)
+		}
+		report, err := d.Sync(ctx, users, p.Progress)
+		if err != nil {
+			return nil, fmt.Errorf("Sync failed: %w", err)
+		}
+		return &control.Result{Message: fmt.Sprintf("Sync completed successfully: %s", report), Payload: report}, nil
+	})
+
+	l.Register(control.PacketTypeSyncUser, func(p *control.Packet) (interface{}, error) {
+		// the username comes from the peer, never the message
+		u, err := peerUser(p.Peer)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("INFO: SyncUser command received. Running sync for", u.Username)
+		report, err := d.SyncUser(progress.WithFunc(ctx, p.Progress), u.Username)
+		if err != nil {
+			log.Printf("WARN: Sync for %s failed: %v\n", u.Username, err)
+			return nil, fmt.Errorf("Sync failed: %w", err)
+		}
+		return &control.Result{Message: fmt.Sprintf("Sync completed successfully: %s", report), Payload: report}, nil
+	})
+
+	l.Register(control.PacketTypeSubscribe, func(p *control.Packet) (interface{}, error) {
+		if p.Legacy() {
+			return nil, control.Errorf(control.ErrorCodeUnsupportedVersion, "Subscribe requires protocol version %d", control.ProtocolVersion)
+		}
+		var types []string
+		if err := p.Decode(&types); err != nil {
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal event types: %v", err)
+		}
+		filter := make(map[string]bool)
+		for _, t := range types {
+			filter[t] = true
+		}
+
+		log.Println("INFO: Subscribe command received. Sending events to", p.Peer)
+		ch, cancel := d.events.Subscribe()
+		defer cancel()
+		for {
+			select {
+			case e := <-ch:
+				if len(filter) > 0 && !filter[e.Type] {
+					continue
+				}
+				if err := p.Emit(control.PacketTypeEvent, e.String(), e); err != nil {
+					log.Println("WARN: Unable to send event:", err)
+					return nil, err
+				}
+			case <-p.Context().Done():
+				log.Println("INFO: Subscriber disconnected:", p.Peer)
+				return "Subscription ended", nil
+			case <-ctx.Done():
+				return "Server shutting down", nil
+			}
+		}
+	})
+
+	l.Register(control.PacketTypeStatus, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: Status command received. Reading status")
+		status, err := d.Status()
+		if err != nil {
+			log.Println("WARN: Reading status failed:", err)
+			return nil, fmt.Errorf("Reading status failed: %w", err)
+		}
+		return status, nil
+	})
+
+	l.Register(control.PacketTypeClearCache, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: ClearCache command received. Clearing cache")
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := ClearCache(progress.WithFunc(ctx, p.Progress), d.Config(), d.client, d.store); err != nil {
+			log.Println("WARN: Clearing cache failed:", err)
+			return nil, fmt.Errorf("Clearing cache failed: %w", err)
+		}
+		d.client.ClearCache()
+		return "Cache cleared successfully", nil
+	})
+
+	l.Register(control.PacketTypeListDrivers, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: ListDrivers command received. Querying CUPS")
+		drivers, err := d.client.GetPPDs()
+		if err != nil {
+			log.Println("WARN: Querying CUPS failed:", err)
+			return nil, fmt.Errorf("Querying CUPS failed: %w", err)
+		}
+		return drivers, nil
+	})
+
+	l.Register(control.PacketTypeListPrinters, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: ListPrinters command received. Querying CUPS")
+		d.statusMu.Lock()
+		apiPrinters := d.apiPrinters
+		d.statusMu.Unlock()
+		list, err := ListPrinters(d.client, d.store, apiPrinters)
+		if err != nil {
+			log.Println("WARN: Listing printers failed:", err)
+			return nil, fmt.Errorf("Listing printers failed: %w", err)
+		}
+		if p.Legacy() && p.Message == control.FormatJSON {
+			return []*PrinterListing(list), nil
+		}
+		return list, nil
+	})
+
+	l.Register(control.PacketTypeWhy, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: Why command received. Reading cache")
+		var id string
+		if err := p.Decode(&id); err != nil {
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal id: %v", err)
+		}
+		why, err := Why(d.store, id)
+		if err != nil {
+			log.Println("WARN: Reading cache failed:", err)
+			return nil, fmt.Errorf("Reading cache failed: %w", err)
+		}
+		return why, nil
+	})
+
+	l.Register(control.PacketTypeCacheList, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: CacheList command received. Reading cache")
+		list, err := CacheList(d.store)
+		if err != nil {
+			log.Println("WARN: Reading cache failed:", err)
+			return nil, fmt.Errorf("Reading cache failed: %w", err)
+		}
+		return list, nil
+	})
+
+	l.Register(control.PacketTypeCacheExtend, func(p *control.Packet) (interface{}, error) {
+		msg := new(control.CacheExtendMessage)
+		if err := p.Decode(msg); err != nil {
+			log.Println("WARN: Unable to unmarshal cache extend message:", err)
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal message: %v", err)
+		}
+		log.Println("INFO: CacheExtend command received. Updating cache")
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		resp, err := CacheExtend(d.store, msg.ID, msg.Duration)
+		if err != nil {
+			log.Println("WARN: Updating cache failed:", err)
+			return nil, fmt.Errorf("Updating cache failed: %w", err)
+		}
+		return resp, nil
+	})
+
+	l.Register(control.PacketTypeCacheEvict, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: CacheEvict command received. Evicting printer")
+		var id string
+		if err := p.Decode(&id); err != nil {
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal id: %v", err)
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		resp, err := CacheEvict(progress.WithFunc(ctx, p.Progress), d.Config(), d.client, d.store, id)
+		if err != nil {
+			log.Println("WARN: Evicting printer failed:", err)
+			return nil, fmt.Errorf("Evicting printer failed: %w", err)
+		}
+		return resp, nil
+	})
+
+	l.Register(control.PacketTypeCacheExport, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: CacheExport command received. Reading cache")
+		export, err := CacheExport(d.store)
+		if err != nil {
+			log.Println("WARN: Exporting cache failed:", err)
+			return nil, fmt.Errorf("Exporting cache failed: %w", err)
+		}
+		return json.RawMessage(export), nil
+	})
+
+	l.Register(control.PacketTypeCacheImport, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: CacheImport command received. Importing cache")
+		var export json.RawMessage
+		if err := p.Decode(&export); err != nil {
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal export: %v", err)
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		resp, err := CacheImport(progress.WithFunc(ctx, p.Progress), d.Config(), d.client, d.store, string(export))
+		if err != nil {
+			log.Println("WARN: Importing cache failed:", err)
+			return nil, fmt.Errorf("Importing cache failed: %w", err)
+		}
+		return resp, nil
+	})
+
+	l.Register(control.PacketTypeConfigValidate, func(p *control.Packet) (interface{}, error) {
+		var path string
+		if err := p.Decode(&path); err != nil {
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Unable to unmarshal path: %v", err)
+		}
+		if path == "" {
+			path = d.configPath
+		}
+		if _, err := LoadConfig(path); err != nil {
+			return nil, control.Errorf(control.ErrorCodeBadRequest, "Configuration is invalid: %v", err)
+		}
+		return "Configuration is valid", nil
+	})
+
+	l.Register(control.PacketTypeConfigReload, func(p *control.Packet) (interface{}, error) {
+		log.Println("INFO: ConfigReload command received. Reloading configuration")
+		resp, err := d.Reload()
+		if err != nil {
+			log.Println("WARN: Reloading configuration failed:", err)
+			return nil, fmt.Errorf("Reloading configuration failed: %w", err)
+		}
+		return resp, nil
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPingWatchdog(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		syncing      bool
+		lastProgress time.Time
+		notify       bool
+	}{
+		{"idle", false, time.Time{}, true},
+		{"idle after old sync", false, time.Now().Add(-2 * SyncStallTimeout), true},
+		{"syncing with recent progress", true, time.Now(), true},
+		{"stalled sync", true, time.Now().Add(-2 * SyncStallTimeout), false},
+	} {
+		ticks := make(chan time.Time)
+		notified := make(chan string, 10)
+		d := NewDaemon("", new(Config), nil, nil)
+		d.watchdog = ticks
+		d.notify = func(state string) { notified <- state }
+		d.syncing, d.lastProgress = test.syncing, test.lastProgress
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			d.pingWatchdog(ctx)
+			close(done)
+		}()
+		ticks <- time.Now()
+		ticks <- time.Now()
+		cancel()
+		<-done
+
+		if n := len(notified); (n == 2) != test.notify || (n == 0) == test.notify {
+			t.Errorf("%s: expected notifications %v, got %d", test.name, test.notify, n)
+		}
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	d := NewDaemon("", &Config{SyncInterval: 50 * time.Millisecond}, nil, nil)
+	d.lastSync = time.Now().Add(-time.Hour)
+	d.lastDuration = time.Minute
+
+	// a timer scheduled with the old interval
+	timer := time.NewTimer(24 * time.Hour)
+	d.reschedule(timer)
+	if expected := d.lastSync.Add(time.Minute + 50*time.Millisecond); !d.nextSync.Equal(expected) {
+		t.Errorf("expected next sync %v, got %v", expected, d.nextSync)
+	}
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatal("expected overdue sync to run immediately")
+	}
+
+	d.lastSync, d.lastDuration = time.Now(), 0
+	d.reschedule(timer)
+	select {
+	case <-timer.C:
+		t.Fatal("expected sync to wait for the new interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatal("expected sync after the new interval")
+	}
+}
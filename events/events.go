@@ -0,0 +1,102 @@
+// Package events publishes printer and sync events to subscribers
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	SyncStarted     = "sync_started"
+	SyncFinished    = "sync_finished"
+	PrinterAdded    = "printer_added"
+	PrinterModified = "printer_modified"
+	PrinterRemoved  = "printer_removed"
+	DefaultChanged  = "default_changed"
+	APIUnreachable  = "api_unreachable"
+	CUPSUnreachable = "cups_unreachable"
+)
+
+// Event is a change in printers or the daemon's state
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Printer string    `json:"printer,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+func (e *Event) String() string {
+	s := fmt.Sprintf("%s %s", e.Time.Format(time.RFC3339), e.Type)
+	if e.Printer != "" {
+		s += " " + e.Printer
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// SubscriberBuffer is the number of Events buffered for each subscriber. Events are dropped for subscribers with full buffers
+var SubscriberBuffer = 64
+
+// Broker fans out published Events to subscribers
+type Broker struct {
+	mu   sync.Mutex
+	subs map[chan *Event]struct{}
+}
+
+// NewBroker returns a new Broker
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[chan *Event]struct{})}
+}
+
+// Subscribe returns a channel of published Events and a function to cancel the subscription
+func (b *Broker) Subscribe() (<-chan *Event, func()) {
+	ch := make(chan *Event, SubscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Publish sends e to all subscribers without blocking
+func (b *Broker) Publish(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Println("WARN: Dropped event for slow subscriber:", e.Type)
+		}
+	}
+}
+
+type key struct{}
+
+// WithBroker returns a copy of ctx that publishes Events to b
+func WithBroker(ctx context.Context, b *Broker) context.Context {
+	return context.WithValue(ctx, key{}, b)
+}
+
+// Publish publishes an Event of type typ to the Broker in ctx, if any
+func Publish(ctx context.Context, typ, printer, format string, a ...interface{}) {
+	if b, ok := ctx.Value(key{}).(*Broker); ok && b != nil {
+		b.Publish(&Event{Type: typ, Printer: printer, Message: fmt.Sprintf(format, a...)})
+	}
+}
@@ -1,19 +1,27 @@
 module github.com/korylprince/printer-manager-cups
 
-go 1.14
+go 1.19
 
 require (
-	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgraph-io/badger/v2 v2.2007.4
+	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/phin1x/go-ipp v1.6.2-0.20230912085407-24e049b4d9fc
+	go.etcd.io/bbolt v1.3.7
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgraph-io/ristretto v0.1.1 // indirect
 	github.com/dgryski/go-farm v0.0.0-20200201041132-a6ae2369ad13 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/golang/glog v1.1.2 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/klauspost/compress v1.16.7 // indirect
-	github.com/phin1x/go-ipp v1.6.2-0.20230912085407-24e049b4d9fc
+	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/net v0.14.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -1,10 +1,12 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/korylprince/printer-manager-cups/cups"
 )
@@ -13,13 +15,30 @@ const apiPath = "/users/%s/printers"
 
 var idRegexp = regexp.MustCompile("[^0-9a-zA-Z]")
 
-func GetPrinters(apiBase string, usernames []string) ([]*cups.Printer, error) {
+//Timeout is the maximum duration of an API request, including reading the response
+const Timeout = 2 * time.Minute
+
+var client = &http.Client{Timeout: Timeout}
+
+//get returns the response to a GET request for u, which is canceled with ctx, or an error if one occurred
+func get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request: %w", err)
+	}
+	return client.Do(req)
+}
+
+//GetPrinters returns the printers for the given users and a mapping of printer ID to the users that requested it,
+//or an error if one occurred. Requests are canceled with ctx
+func GetPrinters(ctx context.Context, apiBase string, usernames []string) ([]*cups.Printer, map[string][]string, error) {
 	printerSet := make(map[string]*cups.Printer)
+	printerUsers := make(map[string][]string)
 
 	for _, username := range usernames {
-		resp, err := http.Get(apiBase + fmt.Sprintf(apiPath, username))
+		resp, err := get(ctx, apiBase+fmt.Sprintf(apiPath, username))
 		if err != nil {
-			return nil, fmt.Errorf("Unable to query printers: %w", err)
+			return nil, nil, fmt.Errorf("Unable to query printers: %w", err)
 		}
 
 		if resp.StatusCode == http.StatusNotFound {
@@ -32,23 +51,26 @@ func GetPrinters(apiBase string, usernames []string) ([]*cups.Printer, error) {
 		d := json.NewDecoder(resp.Body)
 		if err := d.Decode(&printers); err != nil {
 			resp.Body.Close()
-			return nil, fmt.Errorf("Unable to decode response: %w", err)
+			return nil, nil, fmt.Errorf("Unable to decode response: %w", err)
 		}
 
 		resp.Body.Close()
 
 		for _, p := range printers {
 			printerSet[p.ID] = p
+			printerUsers[p.ID] = append(printerUsers[p.ID], username)
 		}
 	}
 
 	// coalesce printers
 	printers := make([]*cups.Printer, 0, len(printerSet))
-	for _, p := range printerSet {
+	users := make(map[string][]string, len(printerSet))
+	for id, p := range printerSet {
 		// sanitize id to be compatible with cups sanitation (particularly for CUPS-Create-Local-Printer
 		p.ID = idRegexp.ReplaceAllString(p.ID, "")
 		printers = append(printers, p)
+		users[p.ID] = append(users[p.ID], printerUsers[id]...)
 	}
 
-	return printers, nil
+	return printers, users, nil
 }
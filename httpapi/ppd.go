@@ -0,0 +1,123 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/korylprince/printer-manager-cups/cups"
+)
+
+//MaxPPDSize is the maximum size of a downloaded PPD file
+const MaxPPDSize = 16 << 20
+
+//DownloadPPD downloads f to dir, named by its checksum, and returns the file path, or an error if one occurred.
+//Relative URLs are resolved against apiBase, and URLs with the API scheme and host use the API credentials.
+//Previously downloaded files are reused if their checksum matches. The download is canceled with ctx
+func DownloadPPD(ctx context.Context, apiBase string, f *cups.PPDFile, dir string) (string, error) {
+	sum := strings.ToLower(f.SHA256)
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("Invalid SHA256 checksum: %s", f.SHA256)
+	}
+
+	u, err := ppdURL(apiBase, f.URL)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, sum+".ppd")
+	if existing, err := fileSum(path); err == nil && existing == sum {
+		return path, nil
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("Unable to create PPD directory: %w", err)
+	}
+
+	resp, err := get(ctx, u)
+	if err != nil {
+		return "", fmt.Errorf("Unable to download PPD: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to download PPD: unexpected status: %s", resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "download-*.ppd")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, MaxPPDSize+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to write PPD: %w", err)
+	}
+	if n > MaxPPDSize {
+		return "", fmt.Errorf("PPD is larger than %d bytes", MaxPPDSize)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sum {
+		return "", fmt.Errorf("PPD checksum mismatch: expected %s, got %s", sum, actual)
+	}
+
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", fmt.Errorf("Unable to set PPD permissions: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("Unable to move PPD: %w", err)
+	}
+
+	return path, nil
+}
+
+//ppdURL returns rawurl resolved against apiBase, with the API credentials added if it has the API scheme and host
+func ppdURL(apiBase, rawurl string) (string, error) {
+	base, err := url.Parse(apiBase)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse API base URL: %w", err)
+	}
+	ref, err := url.Parse(rawurl)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse PPD URL: %w", err)
+	}
+
+	u := base.ResolveReference(ref)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("PPD URL must use http or https")
+	}
+	// credentials must not be sent to another origin, or in plain text if the API uses https
+	if u.User == nil && u.Scheme == base.Scheme && u.Host == base.Host {
+		u.User = base.User
+	}
+	return u.String(), nil
+}
+
+//fileSum returns the hex-encoded SHA-256 checksum of the file at path, or an error if one occurred
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korylprince/printer-manager-cups/cache"
+	"github.com/korylprince/printer-manager-cups/cups"
+)
+
+// Printer sources
+const (
+	// SourceAPI printers were returned by the API in the last sync
+	SourceAPI = "api"
+	// SourceCache printers are managed, but weren't returned by the API in the last sync
+	SourceCache = "cache"
+	// SourceLocal printers aren't managed
+	SourceLocal = "local"
+)
+
+// StateNotInstalled is the State of a managed printer that isn't installed in CUPS
+const StateNotInstalled = "not installed"
+
+// PrinterListing describes an installed or managed printer
+type PrinterListing struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Location   string     `json:"location"`
+	DeviceURI  string     `json:"device_uri"`
+	Driver     string     `json:"driver"`
+	Managed    bool       `json:"managed"`
+	Source     string     `json:"source"`
+	Users      []string   `json:"users"`
+	Expiration *time.Time `json:"expiration"`
+	State      string     `json:"state"`
+	Reasons    []string   `json:"reasons"`
+	Default    bool       `json:"default"`
+}
+
+// PrinterList is a list of PrinterListings, formatted as a table by String
+type PrinterList []*PrinterListing
+
+// ListPrinters returns listings for all printers installed in CUPS or managed in the cache, sorted by ID,
+// or an error if one occurred. apiPrinters are the printers returned by the API in the last sync
+func ListPrinters(client *cups.Client, store cache.Store, apiPrinters []*cups.Printer) (PrinterList, error) {
+	// CUPS returns an error if no printers are installed
+	cupsPrinters, err := client.GetPrinters()
+	if err != nil && !strings.Contains(err.Error(), "No destinations added.") {
+		return nil, fmt.Errorf("Unable to get CUPS printers: %w", err)
+	}
+
+	states, err := client.GetPrinterStates()
+	if err != nil && !strings.Contains(err.Error(), "No destinations added.") {
+		return nil, fmt.Errorf("Unable to get CUPS printer states: %w", err)
+	}
+
+	// a missing default isn't an error
+	def, err := client.GetDefault()
+	if err != nil {
+		log.Println("WARN: Unable to get default printer:", err)
+	}
+
+	pCache, err := store.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read cache: %w", err)
+	}
+
+	api := make(map[string]*cups.Printer, len(apiPrinters))
+	for _, p := range apiPrinters {
+		api[p.ID] = p
+	}
+
+	listings := make(map[string]*PrinterListing)
+
+	for _, p := range cupsPrinters {
+		l := &PrinterListing{ID: p.ID, Name: p.Name, Location: p.Location, DeviceURI: p.Hostname, Source: SourceLocal, Default: p.ID == def}
+		if s, ok := states[p.ID]; ok {
+			l.Driver, l.State, l.Reasons = s.MakeAndModel, s.State, s.Reasons
+		}
+		listings[p.ID] = l
+	}
+
+	for id, e := range pCache.Printers {
+		l, ok := listings[id]
+		if !ok {
+			l = &PrinterListing{ID: id, State: StateNotInstalled}
+			if p := e.Printer; p != nil {
+				l.Name, l.Location, l.DeviceURI = p.GetName(), p.GetLocation(), p.DeviceURI()
+			}
+			listings[id] = l
+		}
+
+		l.Managed = true
+		l.Source = SourceCache
+		if _, ok := api[id]; ok {
+			l.Source = SourceAPI
+		}
+		expiration := e.Expiration
+		l.Expiration = &expiration
+		for u := range e.Users {
+			l.Users = append(l.Users, u)
+		}
+		sort.Strings(l.Users)
+	}
+
+	ids := make([]string, 0, len(listings))
+	for id := range listings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	list := make(PrinterList, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, listings[id])
+	}
+
+	return list, nil
+}
+
+func (list PrinterList) String() string {
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tLOCATION\tDEVICE URI\tDRIVER\tSOURCE\tUSERS\tEXPIRES\tSTATE\tDEFAULT")
+	for _, l := range list {
+		expires := "-"
+		if l.Expiration != nil {
+			expires = l.Expiration.Format(time.RFC3339)
+		}
+		state := l.State
+		if len(l.Reasons) > 0 {
+			state += " (" + strings.Join(l.Reasons, ",") + ")"
+		}
+		def := ""
+		if l.Default {
+			def = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			l.ID, l.Name, l.Location, l.DeviceURI, l.Driver, l.Source, strings.Join(l.Users, ","), expires, state, def,
+		)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -1,106 +1,174 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/kelseyhightower/envconfig"
+	"github.com/korylprince/printer-manager-cups/cache"
 	"github.com/korylprince/printer-manager-cups/control"
 	"github.com/korylprince/printer-manager-cups/cups"
+	"github.com/korylprince/printer-manager-cups/httpapi"
+	"github.com/korylprince/printer-manager-cups/systemd"
 )
 
 func main() {
-	c := new(Config)
-	if err := envconfig.Process("", c); err != nil {
-		log.Fatalln("ERROR: Unable to process configuration:", err)
+	configPath := flag.String("config", os.Getenv(ConfigFileEnv), "path to optional YAML configuration file")
+	flag.Parse()
+
+	c, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln("ERROR: Invalid configuration:", err)
 	}
 
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "validate-config":
+			log.Println("INFO: Configuration is valid")
+			return
+		case "migrate-cache":
+			if flag.NArg() != 3 {
+				log.Fatalf("Usage: %s migrate-cache [from backend] [to backend]\n", os.Args[0])
+			}
+			if err := cache.Migrate(c.CachePath, flag.Arg(1), flag.Arg(2)); err != nil {
+				log.Fatalln("ERROR: Unable to migrate cache:", err)
+			}
+			log.Println("INFO: Migrated cache from", flag.Arg(1), "to", flag.Arg(2))
+			return
+		default:
+			log.Fatalln("ERROR: Unknown command:", flag.Arg(0))
+		}
+	}
+
+	// cancel running operations on shutdown; a second signal exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	client, err := cups.New()
 	if err != nil {
 		log.Fatalln("ERROR: Unable to create CUPS client:", err)
 	}
+	client.DriverPolicy = c.DriverPolicy()
 
-	con, err := control.New()
+	store, quarantined, err := cache.Open(c.CacheBackend, c.CachePath)
 	if err != nil {
-		log.Fatalln("ERROR: Unable to set up control socket:", err)
+		log.Fatalln("ERROR: Unable to open cache:", err)
 	}
 
-	inputSync := make(chan []string)
-	inputClearCache := make(chan struct{})
-	inputListDrivers := make(chan struct{})
-	output := make(chan string)
+	if quarantined != "" {
+		log.Println("WARN: Cache database was corrupt and has been moved to", quarantined, "- rebuilding cache from CUPS")
+		if err = RecoverCache(ctx, c, client, store); err != nil {
+			log.Println("WARN: Unable to rebuild cache:", err)
+		}
+	}
 
-	con.Register(control.PacketTypeSync, func(p *control.Packet) *control.Packet {
-		users := make([]string, 0)
-		if p.Message == "" {
-			inputSync <- nil
-		} else {
-			if err = json.Unmarshal([]byte(p.Message), &users); err != nil {
-				log.Println("WARN: Unable to unmarshal users:", err)
-				return &control.Packet{Type: control.PacketTypeResponse, Message: fmt.Sprintf("Unable to unmarshal users: %v", err)}
-			}
-			inputSync <- users
+	var con *control.Listener
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalln("ERROR: Unable to get socket activated listeners:", err)
+	}
+	if len(listeners) > 0 {
+		// the socket unit and configuration must agree, or clients using SocketPath won't find the server
+		if addr := listeners[0].Addr().String(); c.SocketPath != "" && addr != c.SocketPath {
+			log.Fatalf("ERROR: Socket activated control socket (%s) differs from SocketPath (%s)\n", addr, c.SocketPath)
 		}
-		return &control.Packet{Type: control.PacketTypeResponse, Message: <-output}
-	})
+		con = control.NewFromListener(listeners[0])
+	} else if con, err = control.New(c.SocketOptions()); err != nil {
+		log.Fatalln("ERROR: Unable to set up control socket:", err)
+	}
 
-	con.Register(control.PacketTypeClearCache, func(p *control.Packet) *control.Packet {
-		inputClearCache <- struct{}{}
-		return &control.Packet{Type: control.PacketTypeResponse, Message: <-output}
-	})
+	var watchdog <-chan time.Time
+	if interval, err := systemd.WatchdogInterval(); err != nil {
+		log.Println("WARN: Unable to get watchdog interval:", err)
+	} else if interval > 0 {
+		watchdog = time.NewTicker(interval / 2).C
+	}
 
-	con.Register(control.PacketTypeListDrivers, func(p *control.Packet) *control.Packet {
-		inputListDrivers <- struct{}{}
-		return &control.Packet{Type: control.PacketTypeResponse, Message: <-output}
-	})
+	d := NewDaemon(*configPath, c, client, store)
+	d.watchdog = watchdog
+	d.notify = notify
+	client.FetchPPD = func(ctx context.Context, f *cups.PPDFile) (string, error) {
+		return httpapi.DownloadPPD(ctx, d.Config().APIBase, f, filepath.Join(c.CachePath, PPDDir))
+	}
+	d.Register(ctx, con)
+	go d.Run(ctx)
 
 	log.Println("INFO: Listening for commands on", con.Socket)
 
-	t := time.NewTimer(0)
+	var admin *AdminServer
+	if c.HTTPListen != "" {
+		if admin, err = NewAdminServer(c, con); err != nil {
+			log.Fatalln("ERROR: Unable to start HTTP admin API:", err)
+		}
+		log.Println("INFO: Serving HTTP admin API on", admin.Addr)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
+loop:
 	for {
 		select {
-		case users := <-inputSync:
-			log.Println("INFO: Sync command received. Running sync")
-			if err := Sync(c, client, users); err != nil {
-				log.Println("WARN: Sync failed:", err)
-				output <- fmt.Sprintf("Sync failed: %v", err)
-				break
-			}
-			output <- "Sync completed successfully"
-		case <-inputClearCache:
-			log.Println("INFO: ClearCache command received. Clearing cache")
-			if err := ClearCache(c, client); err != nil {
-				log.Println("WARN: Clearing cache failed:", err)
-				output <- fmt.Sprintf("Clearing cache failed: %v", err)
-				break
-			}
-			client.ClearCache()
-			output <- "Cache cleared successfully"
-		case <-inputListDrivers:
-			log.Println("INFO: ListDrivers command received. Querying CUPS")
-			drivers, err := client.GetPPDs()
-			if err != nil {
-				log.Println("WARN: Querying CUPS failed:", err)
-				output <- fmt.Sprintf("Querying CUPS failed: %v", err)
-				break
-			}
-			buf, err := json.MarshalIndent(drivers, "", "\t")
-			if err != nil {
-				log.Println("WARN: Marshalling drivers failed:", err)
-				output <- fmt.Sprintf("Marshalling drivers failed: %v", err)
-				break
-			}
-			output <- string(buf)
-		case <-t.C:
-			if err := Sync(c, client, nil); err != nil {
-				log.Println("WARN: Sync failed:", err)
+		case <-ctx.Done():
+			break loop
+		case <-hup:
+			log.Println("INFO: SIGHUP received. Reloading configuration")
+			if _, err := d.Reload(); err != nil {
+				log.Println("WARN: Reloading configuration failed:", err)
 			}
 		}
+	}
+
+	log.Println("INFO: Shutting down")
+	notify("STOPPING=1")
+	status := 0
+
+	if err = con.Close(); err != nil {
+		log.Println("WARN: Unable to close control socket:", err)
+		status = 1
+	}
+
+	if admin != nil {
+		if err = admin.Close(); err != nil {
+			log.Println("WARN: Unable to close HTTP admin API:", err)
+			status = 1
+		}
+	}
+
+	// wait for the running sync or command to finish before closing the cache
+	d.Wait()
+
+	if err = store.Close(); err != nil {
+		log.Println("WARN: Unable to close cache:", err)
+		status = 1
+	}
+
+	log.Println("INFO: Shutdown complete")
+	os.Exit(status)
+}
 
-		t.Stop()
-		t.Reset(c.SyncInterval)
+// notify sends state to systemd if running under it
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Println("WARN: Unable to notify systemd:", err)
+	}
+}
+
+// syncStatus returns a one-line description of a sync that started at start
+func syncStatus(start time.Time, report *SyncReport, err error) string {
+	status := fmt.Sprintf("Last sync at %s took %s: ", start.Format(time.RFC3339), time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		return status + fmt.Sprintf("failed: %v", err)
 	}
+	return status + strings.SplitN(report.String(), "\n", 2)[0]
 }
@@ -0,0 +1,24 @@
+// Package progress reports progress of long-running operations to interested callers through a context
+package progress
+
+import (
+	"context"
+	"fmt"
+)
+
+// Func receives progress messages
+type Func func(msg string)
+
+type key struct{}
+
+// WithFunc returns a copy of ctx that reports progress to f
+func WithFunc(ctx context.Context, f Func) context.Context {
+	return context.WithValue(ctx, key{}, f)
+}
+
+// Report formats a progress message and sends it to the Func in ctx, if any
+func Report(ctx context.Context, format string, a ...interface{}) {
+	if f, ok := ctx.Value(key{}).(Func); ok && f != nil {
+		f(fmt.Sprintf(format, a...))
+	}
+}
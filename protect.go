@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"github.com/korylprince/printer-manager-cups/cups"
+)
+
+// IsProtected returns true if the CUPS printer should never be deleted or modified.
+// A printer is protected if its name matches a ProtectedPrinters glob, starts with ProtectedPrefix,
+// or its description or location contains ProtectedMarker
+func (c *Config) IsProtected(p *cups.Printer) bool {
+	for _, pattern := range c.ProtectedPrinters {
+		if ok, err := path.Match(pattern, p.ID); err != nil {
+			log.Printf("WARN: Invalid ProtectedPrinters pattern %s: %v\n", pattern, err)
+		} else if ok {
+			return true
+		}
+	}
+
+	if c.ProtectedPrefix != "" && strings.HasPrefix(p.ID, c.ProtectedPrefix) {
+		return true
+	}
+
+	if c.ProtectedMarker != "" && (strings.Contains(p.Name, c.ProtectedMarker) || strings.Contains(p.Location, c.ProtectedMarker)) {
+		return true
+	}
+
+	return false
+}
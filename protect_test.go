@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/korylprince/printer-manager-cups/cups"
+)
+
+func TestInstalledPrinterIsProtected(t *testing.T) {
+	config := &Config{ProtectedPrinters: []string{"lab-*"}, ProtectedPrefix: "local_", ProtectedMarker: "[protected]"}
+	for _, test := range []struct {
+		name      string
+		installed *installedPrinter
+		protected bool
+	}{
+		{"not installed", nil, false},
+		{"pending install", &installedPrinter{Info: "[protected]"}, false},
+		{"unprotected", &installedPrinter{printer: &cups.Printer{ID: "printer1", Name: "Printer 1"}}, false},
+		{"glob", &installedPrinter{printer: &cups.Printer{ID: "lab-1"}}, true},
+		{"prefix", &installedPrinter{printer: &cups.Printer{ID: "local_printer"}}, true},
+		{"description marker", &installedPrinter{printer: &cups.Printer{ID: "printer1", Name: "Front desk [protected]"}}, true},
+		{"location marker", &installedPrinter{printer: &cups.Printer{ID: "printer1", Location: "[protected] Office"}}, true},
+	} {
+		if protected := test.installed.isProtected(config); protected != test.protected {
+			t.Errorf("%s: expected protected %v, got %v", test.name, test.protected, protected)
+		}
+	}
+}
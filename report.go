@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/korylprince/printer-manager-cups/cups"
+)
+
+// Duplicate actions describe what was done with a Duplicate
+const (
+	DuplicateDeleted   = "deleted"
+	DuplicateDisabled  = "disabled"
+	DuplicateReported  = "reported"
+	DuplicateProtected = "protected"
+	// DuplicateDeferred means deletion was deferred because the printer has active jobs
+	DuplicateDeferred = "deferred"
+	// DuplicateFailed means the DuplicatePolicy couldn't be applied; Error describes why
+	DuplicateFailed = "failed"
+)
+
+// Duplicate is an unmanaged printer that matched a managed printer
+type Duplicate struct {
+	ID        string `json:"id"`
+	DeviceURI string `json:"device_uri"`
+	MatchedID string `json:"matched_id"`
+	// Action is one of the Duplicate actions
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SyncReport summarizes the changes made during a sync
+type SyncReport struct {
+	Added   []string `json:"added"`
+	Failed  []string `json:"failed"`
+	Expired []string `json:"expired"`
+	// Deferred are printers not deleted because they have active jobs
+	Deferred   []string     `json:"deferred"`
+	Duplicates []*Duplicate `json:"duplicates"`
+	// Protected are printers that would have been deleted or modified, but were protected
+	Protected []string `json:"protected"`
+	// Drivers are the drivers chosen for added/modified printers
+	Drivers map[string]*cups.DriverMatch `json:"drivers,omitempty"`
+	// Printers are the printers returned by the API
+	Printers []*cups.Printer `json:"-"`
+}
+
+// addDriver records the driver chosen for the printer with the given id
+func (r *SyncReport) addDriver(id string, driver *cups.DriverMatch) {
+	if r.Drivers == nil {
+		r.Drivers = make(map[string]*cups.DriverMatch)
+	}
+	r.Drivers[id] = driver
+}
+
+func (r *SyncReport) String() string {
+	s := fmt.Sprintf("%d added/modified, %d failed, %d expired", len(r.Added), len(r.Failed), len(r.Expired))
+	if len(r.Failed) > 0 {
+		s += fmt.Sprintf("\nFailed: %s", strings.Join(r.Failed, ", "))
+	}
+	if len(r.Deferred) > 0 {
+		s += fmt.Sprintf("\nDeferred (active jobs): %s", strings.Join(r.Deferred, ", "))
+	}
+	if len(r.Protected) > 0 {
+		s += fmt.Sprintf("\nProtected: %s", strings.Join(r.Protected, ", "))
+	}
+	for _, d := range r.Duplicates {
+		s += fmt.Sprintf("\nDuplicate %s (%s) of %s: %s", d.ID, d.DeviceURI, d.MatchedID, d.Action)
+		if d.Error != "" {
+			s += fmt.Sprintf(": %s", d.Error)
+		}
+	}
+	return s
+}
@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"math/rand"
 	"time"
 )
@@ -22,8 +23,14 @@ type Strategy struct {
 	ShouldRetryFunc func(err error) error
 }
 
-// Retry tries f(), returning an error if MaxTries is exhausted
-func (s *Strategy) Retry(f func() error) error {
+// Retry tries f(), returning an error if MaxTries is exhausted or ctx.Err() if ctx is canceled while waiting to retry
+func (s *Strategy) Retry(ctx context.Context, f func() error) error {
+	return s.RetryNotify(ctx, f, nil)
+}
+
+// RetryNotify is like Retry, but calls notify (if not nil) with the number of tries, the error,
+// and the backoff duration before each retry
+func (s *Strategy) RetryNotify(ctx context.Context, f func() error, notify func(tries int, err error, wait time.Duration)) error {
 	tries := 0
 	backoff := s.Initial
 	for {
@@ -47,7 +54,17 @@ func (s *Strategy) Retry(f func() error) error {
 			}
 		}
 
-		time.Sleep(backoff + time.Duration(rand.Int63n(int64(s.MaxJitter))))
+		wait := backoff + time.Duration(rand.Int63n(int64(s.MaxJitter)))
+		if notify != nil {
+			notify(tries, err, wait)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
 		backoff *= 2
 	}
 }
@@ -0,0 +1,51 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryNotifyCanceled(t *testing.T) {
+	s := &Strategy{Initial: time.Hour, MaxRetries: 5, MaxDuration: time.Hour, MaxJitter: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	errTry := errors.New("try failed")
+
+	tries := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- s.RetryNotify(ctx, func() error {
+			tries++
+			return errTry
+		}, func(int, error, time.Duration) { cancel() })
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+		if tries != 1 {
+			t.Errorf("expected 1 try, got %d", tries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RetryNotify didn't return after ctx was canceled")
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	s := &Strategy{Initial: time.Millisecond, MaxRetries: 3, MaxDuration: time.Millisecond, MaxJitter: time.Millisecond}
+	errTry := errors.New("try failed")
+
+	tries := 0
+	if err := s.Retry(context.Background(), func() error {
+		tries++
+		return errTry
+	}); !errors.Is(err, errTry) {
+		t.Errorf("expected %v, got %v", errTry, err)
+	}
+	if tries != 3 {
+		t.Errorf("expected 3 tries, got %d", tries)
+	}
+}
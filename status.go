@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/korylprince/printer-manager-cups/user"
+)
+
+// Version is the daemon version, set at build time with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// Status is a snapshot of the daemon's state
+type Status struct {
+	Version string        `json:"version"`
+	Started time.Time     `json:"started"`
+	Uptime  time.Duration `json:"uptime"`
+
+	APIBase         string        `json:"api_base"`
+	CacheBackend    string        `json:"cache_backend"`
+	CachePath       string        `json:"cache_path"`
+	SyncInterval    time.Duration `json:"sync_interval"`
+	DuplicatePolicy string        `json:"duplicate_policy"`
+	ActiveJobPolicy string        `json:"active_job_policy"`
+
+	Syncing      bool          `json:"syncing"`
+	LastSync     time.Time     `json:"last_sync"`
+	LastDuration time.Duration `json:"last_duration,omitempty"`
+	LastResult   string        `json:"last_result,omitempty"`
+	LastError    string        `json:"last_error,omitempty"`
+	NextSync     time.Time     `json:"next_sync"`
+
+	Users           []string `json:"users"`
+	ManagedPrinters int      `json:"managed_printers"`
+	CacheSize       int64    `json:"cache_size"`
+}
+
+// redactURL returns rawurl with any password redacted, since Status is available to every local user.
+// If rawurl can't be parsed, only its scheme and host are returned
+func redactURL(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil {
+		return u.Redacted()
+	}
+
+	scheme, rest := "", rawurl
+	if idx := strings.Index(rawurl, "://"); idx != -1 {
+		scheme, rest = rawurl[:idx+3], rawurl[idx+3:]
+	}
+	if idx := strings.IndexAny(rest, "/?#"); idx != -1 {
+		rest = rest[:idx]
+	}
+	if idx := strings.LastIndex(rest, "@"); idx != -1 {
+		rest = rest[idx+1:]
+	}
+	return scheme + rest
+}
+
+// Status returns the daemon's current Status or an error if one occurred
+func (d *Daemon) Status() (*Status, error) {
+	c := d.Config()
+	s := &Status{
+		Version:         Version,
+		Started:         d.started,
+		Uptime:          time.Since(d.started).Round(time.Second),
+		APIBase:         redactURL(c.APIBase),
+		CacheBackend:    c.CacheBackend,
+		CachePath:       c.CachePath,
+		SyncInterval:    c.SyncInterval,
+		DuplicatePolicy: c.DuplicatePolicy,
+		ActiveJobPolicy: c.ActiveJobPolicy,
+	}
+
+	d.statusMu.Lock()
+	s.Syncing = d.syncing
+	s.LastSync = d.lastSync
+	s.LastDuration = d.lastDuration
+	if d.lastReport != nil {
+		s.LastResult = strings.SplitN(d.lastReport.String(), "\n", 2)[0]
+	}
+	if d.lastErr != nil {
+		s.LastError = d.lastErr.Error()
+	}
+	s.NextSync = d.nextSync
+	d.statusMu.Unlock()
+
+	// status is still useful if users can't be read
+	users, err := user.GetUsers()
+	if err != nil {
+		log.Println("WARN: Unable to get users:", err)
+	}
+	s.Users = users
+
+	pCache, err := d.store.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read cache: %w", err)
+	}
+	s.ManagedPrinters = len(pCache.Printers)
+
+	if s.CacheSize, err = dirSize(c.CachePath); err != nil {
+		return nil, fmt.Errorf("Unable to get cache size: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *Status) String() string {
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", s.Version)
+	fmt.Fprintf(w, "Started:\t%s (up %s)\n", s.Started.Format(time.RFC3339), s.Uptime)
+	fmt.Fprintf(w, "API:\t%s\n", s.APIBase)
+	fmt.Fprintf(w, "Cache:\t%s at %s\n", s.CacheBackend, s.CachePath)
+	fmt.Fprintf(w, "Policies:\tduplicate=%s, active jobs=%s\n", s.DuplicatePolicy, s.ActiveJobPolicy)
+	fmt.Fprintf(w, "Sync interval:\t%s\n", s.SyncInterval)
+	if s.Syncing {
+		fmt.Fprintln(w, "Sync running:\tyes")
+	} else {
+		fmt.Fprintln(w, "Sync running:\tno")
+	}
+	switch {
+	case s.LastSync.IsZero():
+		fmt.Fprintln(w, "Last sync:\tnever")
+	case s.LastError != "":
+		fmt.Fprintf(w, "Last sync:\t%s took %s: failed: %s\n", s.LastSync.Format(time.RFC3339), s.LastDuration, s.LastError)
+	default:
+		fmt.Fprintf(w, "Last sync:\t%s took %s: %s\n", s.LastSync.Format(time.RFC3339), s.LastDuration, s.LastResult)
+	}
+	if !s.NextSync.IsZero() {
+		fmt.Fprintf(w, "Next sync:\t%s\n", s.NextSync.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Logged in users:\t%s\n", strings.Join(s.Users, ", "))
+	fmt.Fprintf(w, "Managed printers:\t%d\n", s.ManagedPrinters)
+	fmt.Fprintf(w, "Cache size:\t%d bytes\n", s.CacheSize)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// dirSize returns the total size of the files under path or an error if one occurred
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
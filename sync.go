@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -8,16 +10,26 @@ import (
 
 	"github.com/korylprince/printer-manager-cups/cache"
 	"github.com/korylprince/printer-manager-cups/cups"
+	"github.com/korylprince/printer-manager-cups/events"
 	"github.com/korylprince/printer-manager-cups/httpapi"
+	"github.com/korylprince/printer-manager-cups/progress"
 	"github.com/korylprince/printer-manager-cups/user"
 )
 
-func Sync(config *Config, client *cups.Client, usernames []string) error {
-	log.Println("INFO: Starting sync")
-	// get users
+// Sync installs printers for logged in users and usernames, removes expired printers, and sets the default printer.
+// Events are published for the sync and each change
+func Sync(ctx context.Context, config *Config, client *cups.Client, store cache.Store, usernames []string) (*SyncReport, error) {
+	events.Publish(ctx, events.SyncStarted, "", "")
+	report, err := syncPrinters(ctx, config, client, store, usernames)
+	publishFinished(ctx, report, err)
+	return report, err
+}
+
+// activeUsers returns the logged in users that aren't ignored plus usernames, or an error if one occurred
+func activeUsers(config *Config, usernames []string) ([]string, error) {
 	allUsers, err := user.GetUsers()
 	if err != nil {
-		return fmt.Errorf("Unable to get users: %w", err)
+		return nil, fmt.Errorf("Unable to get users: %w", err)
 	}
 
 	// filter ignored users
@@ -41,91 +53,139 @@ outerIgnored:
 		}
 	}
 
+	return users, nil
+}
+
+func syncPrinters(ctx context.Context, config *Config, client *cups.Client, store cache.Store, usernames []string) (*SyncReport, error) {
+	log.Println("INFO: Starting sync")
+	report := new(SyncReport)
+
+	users, err := activeUsers(config, usernames)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Println("INFO: Getting printers for:", strings.Join(users, ", "))
+	progress.Report(ctx, "Getting printers for %d users: %s", len(users), strings.Join(users, ", "))
 
 	// get api printers
-	printers, err := httpapi.GetPrinters(config.APIBase, users)
+	printers, printerUsers, err := httpapi.GetPrinters(ctx, config.APIBase, users)
 	if err != nil {
-		return fmt.Errorf("Unable to get API printers: %w", err)
+		events.Publish(ctx, events.APIUnreachable, "", "%v", err)
+		return nil, fmt.Errorf("Unable to get API printers: %w", err)
 	}
 
 	log.Println("INFO: Got", len(printers), "printers from API")
+	progress.Report(ctx, "Got %d printers from API", len(printers))
+	report.Printers = printers
+
+	// snapshot installed printers before the cache is updated, to detect modifications
+	installed := installedPrinters(client, store)
+
+	// cache api printer ids and the users that requested them
+	var pCache *cache.Cache
+	if err = store.Update(func(c *cache.Cache) error {
+		now := time.Now()
+		for _, u := range users {
+			c.Users[u] = now
+		}
 
-	// cache api printer ids
-	pCache, err := cache.Read(config.CachePath)
-	if err != nil {
-		return fmt.Errorf("Unable to read cache: %w", err)
-	}
+		for _, p := range printers {
+			e := c.Entry(p.ID)
+			e.Expiration = now.Add(config.CacheTime)
+			e.Printer = p
+			for _, u := range printerUsers[p.ID] {
+				e.AddUser(u, now)
+			}
+		}
 
-	for _, p := range printers {
-		pCache[p.ID] = time.Now().Add(config.CacheTime)
-	}
+		// remove departed users so their printers can expire
+		if expiredUsers := c.ExpireUsers(now.Add(-config.UserCacheTime)); len(expiredUsers) > 0 {
+			log.Println("INFO: Expired users:", strings.Join(expiredUsers, ", "))
+		}
 
-	if err = pCache.Write(config.CachePath); err != nil {
-		return fmt.Errorf("Unable to update cache: %w", err)
+		pCache = c
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Unable to update cache: %w", err)
 	}
 
 	errPrinters := make(map[string]*cups.Printer)
 
 	// sync api printers to cups
 	for _, p := range printers {
-		if err = client.AddOrModify(p); err != nil {
+		if err = ctx.Err(); err != nil {
+			return nil, fmt.Errorf("Sync canceled: %w", err)
+		}
+		if installed[p.ID].isProtected(config) {
+			log.Printf("INFO: Skipped modifying protected printer %s (%s)\n", p.ID, installed[p.ID].DeviceURI)
+			progress.Report(ctx, "Skipped protected printer %s", p.ID)
+			report.Protected = append(report.Protected, p.ID)
+			continue
+		}
+		driver, err := client.AddOrModify(ctx, p)
+		if err != nil {
 			log.Printf("WARN: Unable to add or modify printer %s (%s): %v\n", p.ID, p.Hostname, err)
+			progress.Report(ctx, "Failed to add or modify printer %s: %v", p.ID, err)
 			errPrinters[p.ID] = p
+			report.Failed = append(report.Failed, p.ID)
 			continue
 		}
-		log.Printf("INFO: Added/Modified printer: %s (%s)\n", p.ID, p.Hostname)
+		log.Printf("INFO: Added/Modified printer: %s (%s) using driver %s\n", p.ID, p.Hostname, driver)
+		progress.Report(ctx, "Added/Modified printer %s", p.ID)
+		report.addDriver(p.ID, driver)
+		publishInstalled(ctx, installed[p.ID], p, driver)
+		report.Added = append(report.Added, p.ID)
 	}
+	recordDrivers(store, report.Drivers)
 
 	// get cups printers
 	cupsPrinters, err := client.GetPrinters()
 	if err != nil {
 		if !strings.Contains(err.Error(), "No destinations added.") {
-			return fmt.Errorf("Unable to get CUPS printers: %w", err)
+			events.Publish(ctx, events.CUPSUnreachable, "", "%v", err)
+			return nil, fmt.Errorf("Unable to get CUPS printers: %w", err)
 		}
 	}
 
 	log.Println("INFO: Got", len(cupsPrinters), "printers from CUPS")
 
-	// remove matching, unmanaged printers
-	for _, cp := range cupsPrinters {
-		for _, p := range printers {
-			// skip if same printer
-			if cp.ID == p.ID {
-				continue
-			}
-			// skip error printers
-			if _, ok := errPrinters[p.ID]; ok {
-				continue
-			}
-			// skip if doesn't match
-			if !strings.Contains(cp.Hostname, p.Hostname) {
-				continue
-			}
-
-			if err = client.Delete(cp); err != nil {
-				log.Printf("WARN: Unable to remove matched printer %s: %v\n", cp.ID, err)
-				continue
-			}
-			log.Printf("INFO: Removed matching printer %s (%s): matched %s (%s)\n", cp.ID, cp.Hostname, p.ID, p.Hostname)
-		}
-	}
+	handleDuplicates(ctx, config, client, report, printers, cupsPrinters, errPrinters, pCache)
 
 	// delete expired printers
 	var deleted []string
 outerExpired:
-	for id, expiration := range pCache {
-		if !expiration.Before(time.Now()) {
+	for id, e := range pCache.Printers {
+		if !e.Expiration.Before(time.Now()) {
 			continue
 		}
 
+		if ctx.Err() != nil {
+			break
+		}
+
 		for _, cp := range cupsPrinters {
 			if id == cp.ID {
-				if err = client.Delete(cp); err != nil {
+				if config.IsProtected(cp) {
+					log.Printf("INFO: Skipped deleting protected expired printer %s (%s)\n", cp.ID, cp.Hostname)
+					report.Protected = append(report.Protected, cp.ID)
+					break
+				}
+				deferred, err := deletePrinter(ctx, config, client, cp)
+				if err != nil {
 					log.Printf("WARN: Unable to delete expired printer %s (%s): %v\n", cp.ID, cp.Hostname, err)
 					continue outerExpired
 				}
+				if deferred {
+					log.Printf("INFO: Deferred deleting expired printer %s (%s) with active jobs\n", cp.ID, cp.Hostname)
+					progress.Report(ctx, "Deferred deleting expired printer %s with active jobs", cp.ID)
+					report.Deferred = append(report.Deferred, cp.ID)
+					continue outerExpired
+				}
 				log.Printf("INFO: Deleted expired printer %s (%s)\n", cp.ID, cp.Hostname)
+				progress.Report(ctx, "Deleted expired printer %s", cp.ID)
+				events.Publish(ctx, events.PrinterRemoved, cp.ID, "expired")
+				report.Expired = append(report.Expired, cp.ID)
 				break
 			}
 		}
@@ -133,6 +193,13 @@ outerExpired:
 		deleted = append(deleted, id)
 	}
 
+	if err = ctx.Err(); err != nil {
+		if pErr := purge(store, deleted); pErr != nil {
+			log.Println("WARN: Unable to purge cache:", pErr)
+		}
+		return nil, fmt.Errorf("Sync canceled: %w", err)
+	}
+
 	// get default printer
 	cupsDefault, err := client.GetDefault()
 	if err != nil {
@@ -165,22 +232,312 @@ outerExpired:
 			log.Printf("WARN: Unable to set default printer to %s (%s): %v\n", def.ID, def.Hostname, err)
 		} else {
 			log.Printf("INFO: Set default printer to %s (%s)\n", def.ID, def.Hostname)
+			progress.Report(ctx, "Set default printer to %s", def.ID)
+			events.Publish(ctx, events.DefaultChanged, def.ID, "")
 		}
 	}
 
 	// purge expired printers from cache
-	if err = cache.Purge(config.CachePath, deleted); err != nil {
+	if err = purge(store, deleted); err != nil {
 		log.Println("WARN: Unable to purge cache:", err)
 	}
 
 	log.Println("INFO: Sync completed successfully")
-	return nil
+	return report, nil
+}
+
+// SyncUser adds or modifies the printers for a single user, leaving all other printers untouched.
+// Events are published for the sync and each change
+func SyncUser(ctx context.Context, config *Config, client *cups.Client, store cache.Store, username string) (*SyncReport, error) {
+	events.Publish(ctx, events.SyncStarted, "", "user %s", username)
+	report, err := syncUser(ctx, config, client, store, username)
+	publishFinished(ctx, report, err)
+	return report, err
+}
+
+func syncUser(ctx context.Context, config *Config, client *cups.Client, store cache.Store, username string) (*SyncReport, error) {
+	if config.IgnoreUserCase {
+		username = strings.ToLower(username)
+	}
+	for _, i := range config.IgnoreUsers {
+		if username == i {
+			return nil, fmt.Errorf("%s is an ignored user", username)
+		}
+	}
+
+	log.Println("INFO: Starting sync for", username)
+	report := new(SyncReport)
+
+	printers, _, err := httpapi.GetPrinters(ctx, config.APIBase, []string{username})
+	if err != nil {
+		events.Publish(ctx, events.APIUnreachable, "", "%v", err)
+		return nil, fmt.Errorf("Unable to get API printers: %w", err)
+	}
+
+	log.Println("INFO: Got", len(printers), "printers from API for", username)
+	progress.Report(ctx, "Got %d printers from API for %s", len(printers), username)
+
+	installed := installedPrinters(client, store)
+
+	if err = store.Update(func(c *cache.Cache) error {
+		now := time.Now()
+		c.Users[username] = now
+		for _, p := range printers {
+			e := c.Entry(p.ID)
+			e.Expiration = now.Add(config.CacheTime)
+			e.Printer = p
+			e.AddUser(username, now)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Unable to update cache: %w", err)
+	}
+
+	for _, p := range printers {
+		if err = ctx.Err(); err != nil {
+			return nil, fmt.Errorf("Sync canceled: %w", err)
+		}
+		if installed[p.ID].isProtected(config) {
+			log.Printf("INFO: Skipped modifying protected printer %s (%s)\n", p.ID, installed[p.ID].DeviceURI)
+			progress.Report(ctx, "Skipped protected printer %s", p.ID)
+			report.Protected = append(report.Protected, p.ID)
+			continue
+		}
+		driver, err := client.AddOrModify(ctx, p)
+		if err != nil {
+			log.Printf("WARN: Unable to add or modify printer %s (%s): %v\n", p.ID, p.Hostname, err)
+			progress.Report(ctx, "Failed to add or modify printer %s: %v", p.ID, err)
+			report.Failed = append(report.Failed, p.ID)
+			continue
+		}
+		log.Printf("INFO: Added/Modified printer: %s (%s) using driver %s\n", p.ID, p.Hostname, driver)
+		progress.Report(ctx, "Added/Modified printer %s", p.ID)
+		report.addDriver(p.ID, driver)
+		publishInstalled(ctx, installed[p.ID], p, driver)
+		report.Added = append(report.Added, p.ID)
+	}
+	recordDrivers(store, report.Drivers)
+
+	log.Println("INFO: Sync completed successfully for", username)
+	return report, nil
+}
+
+// recordDrivers saves the chosen drivers, keyed by printer ID, in the printers' cache entries
+func recordDrivers(store cache.Store, drivers map[string]*cups.DriverMatch) {
+	if len(drivers) == 0 {
+		return
+	}
+	if err := store.Update(func(c *cache.Cache) error {
+		for id, driver := range drivers {
+			if e, ok := c.Printers[id]; ok {
+				e.Driver = driver
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Println("WARN: Unable to record drivers in cache:", err)
+	}
+}
+
+// installedPrinter is the installed configuration of a printer
+type installedPrinter struct {
+	// printer is the CUPS printer, or nil for a configuration that's about to be installed
+	printer   *cups.Printer
+	DeviceURI string
+	Info      string
+	Location  string
+	PPD       string
+	Options   map[string]string
+}
+
+// newInstalledPrinter returns the configuration p is installed with using driver
+func newInstalledPrinter(p *cups.Printer, driver *cups.DriverMatch) *installedPrinter {
+	i := &installedPrinter{DeviceURI: p.DeviceURI(), Info: p.GetName(), Location: p.GetLocation()}
+	if driver != nil {
+		i.PPD = driver.PPD
+	}
+	if p.Driver != nil && p.Driver.CUPS != nil {
+		i.Options = p.Options
+	}
+	return i
+}
+
+// changes returns the names of the fields that differ between i and other
+func (i *installedPrinter) changes(other *installedPrinter) []string {
+	var changed []string
+	if i.DeviceURI != other.DeviceURI {
+		changed = append(changed, "device URI")
+	}
+	if i.Info != other.Info {
+		changed = append(changed, "info")
+	}
+	if i.Location != other.Location {
+		changed = append(changed, "location")
+	}
+	if i.PPD != other.PPD {
+		changed = append(changed, "driver")
+	}
+	if len(i.Options) != len(other.Options) {
+		return append(changed, "options")
+	}
+	for k, v := range i.Options {
+		if o, ok := other.Options[k]; !ok || o != v {
+			return append(changed, "options")
+		}
+	}
+	return changed
+}
+
+// installedPrinters returns the installed configuration of CUPS printers, keyed by ID, or an empty map if they can't be retrieved.
+// The driver and options of managed printers are read from the cache, since CUPS doesn't report them
+func installedPrinters(client *cups.Client, store cache.Store) map[string]*installedPrinter {
+	installed := make(map[string]*installedPrinter)
+	cupsPrinters, err := client.GetPrinters()
+	if err != nil && !strings.Contains(err.Error(), "No destinations added.") {
+		log.Println("WARN: Unable to get CUPS printers:", err)
+	}
+
+	pCache, err := store.Read()
+	if err != nil {
+		log.Println("WARN: Unable to read cache:", err)
+		pCache = cache.New()
+	}
+
+	for _, cp := range cupsPrinters {
+		i := &installedPrinter{printer: cp, DeviceURI: cp.Hostname, Info: cp.Name, Location: cp.Location}
+		if e, ok := pCache.Printers[cp.ID]; ok {
+			if e.Driver != nil {
+				i.PPD = e.Driver.PPD
+			}
+			if e.Printer != nil && e.Printer.Driver != nil && e.Printer.CUPS != nil {
+				i.Options = e.Printer.Options
+			}
+		}
+		installed[cp.ID] = i
+	}
+	return installed
+}
+
+// isProtected returns true if installed is a protected CUPS printer, which must not be modified
+func (i *installedPrinter) isProtected(config *Config) bool {
+	return i != nil && i.printer != nil && config.IsProtected(i.printer)
+}
+
+// publishInstalled publishes an added event for p if it wasn't installed,
+// or a modified event if installing it with driver changed its configuration
+func publishInstalled(ctx context.Context, installed *installedPrinter, p *cups.Printer, driver *cups.DriverMatch) {
+	if installed == nil {
+		events.Publish(ctx, events.PrinterAdded, p.ID, "")
+		return
+	}
+	if changed := installed.changes(newInstalledPrinter(p, driver)); len(changed) > 0 {
+		events.Publish(ctx, events.PrinterModified, p.ID, "changed %s", strings.Join(changed, ", "))
+	}
+}
+
+// publishFinished publishes a sync finished event for the result of a sync
+func publishFinished(ctx context.Context, report *SyncReport, err error) {
+	if err != nil {
+		events.Publish(ctx, events.SyncFinished, "", "failed: %v", err)
+		return
+	}
+	events.Publish(ctx, events.SyncFinished, "", "%s", strings.SplitN(report.String(), "\n", 2)[0])
+}
+
+// handleDuplicates applies config.DuplicatePolicy to unmanaged CUPS printers whose device URI matches a managed printer.
+// Printers in pCache are managed, even if they aren't in the current API response (e.g. printers for other users)
+func handleDuplicates(ctx context.Context, config *Config, client *cups.Client, report *SyncReport, printers, cupsPrinters []*cups.Printer, errPrinters map[string]*cups.Printer, pCache *cache.Cache) {
+	managedIDs := make(map[string]bool, len(printers)+len(pCache.Printers))
+	for id := range pCache.Printers {
+		managedIDs[id] = true
+	}
+	for _, p := range printers {
+		managedIDs[p.ID] = true
+	}
+
+	managed := make(map[string]*cups.DeviceURI)
+	for _, p := range printers {
+		// skip error printers
+		if _, ok := errPrinters[p.ID]; ok {
+			continue
+		}
+		uri, err := cups.ParseDeviceURI(p.DeviceURI())
+		if err != nil {
+			log.Printf("WARN: Unable to parse device URI for printer %s (%s): %v\n", p.ID, p.Hostname, err)
+			continue
+		}
+		managed[p.ID] = uri
+	}
+
+	matcher := cups.NewURIMatcher(config.DuplicateResolveDNS)
+
+outer:
+	for _, cp := range cupsPrinters {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// skip managed printers
+		if managedIDs[cp.ID] {
+			continue
+		}
+
+		cpURI, err := cups.ParseDeviceURI(cp.Hostname)
+		if err != nil {
+			// printers with unparseable URIs (e.g. file:/dev/null) can't be duplicates
+			continue
+		}
+
+		for id, uri := range managed {
+			if !matcher.Match(cpURI, uri) {
+				continue
+			}
+
+			d := &Duplicate{ID: cp.ID, DeviceURI: cp.Hostname, MatchedID: id}
+			switch {
+			case config.DuplicatePolicy != DuplicatePolicyReport && config.IsProtected(cp):
+				log.Printf("INFO: Skipped protected matching printer %s (%s): matched %s\n", cp.ID, cp.Hostname, id)
+				d.Action = DuplicateProtected
+				report.Protected = append(report.Protected, cp.ID)
+			case config.DuplicatePolicy == DuplicatePolicyDelete:
+				deferred, err := deletePrinter(ctx, config, client, cp)
+				if err != nil {
+					log.Printf("WARN: Unable to remove matched printer %s: %v\n", cp.ID, err)
+					d.Action, d.Error = DuplicateFailed, fmt.Sprintf("Unable to delete: %v", err)
+					break
+				}
+				if deferred {
+					log.Printf("INFO: Deferred removing matching printer %s (%s) with active jobs: matched %s\n", cp.ID, cp.Hostname, id)
+					d.Action = DuplicateDeferred
+					report.Deferred = append(report.Deferred, cp.ID)
+					break
+				}
+				log.Printf("INFO: Removed matching printer %s (%s): matched %s\n", cp.ID, cp.Hostname, id)
+				events.Publish(ctx, events.PrinterRemoved, cp.ID, "duplicate of %s", id)
+				d.Action = DuplicateDeleted
+			case config.DuplicatePolicy == DuplicatePolicyDisable:
+				if err = client.Disable(cp); err != nil {
+					log.Printf("WARN: Unable to disable matched printer %s: %v\n", cp.ID, err)
+					d.Action, d.Error = DuplicateFailed, fmt.Sprintf("Unable to disable: %v", err)
+					break
+				}
+				log.Printf("INFO: Disabled matching printer %s (%s): matched %s\n", cp.ID, cp.Hostname, id)
+				d.Action = DuplicateDisabled
+			default:
+				log.Printf("INFO: Found matching printer %s (%s): matched %s\n", cp.ID, cp.Hostname, id)
+				d.Action = DuplicateReported
+			}
+			progress.Report(ctx, "Duplicate %s of %s: %s", d.ID, d.MatchedID, d.Action)
+			report.Duplicates = append(report.Duplicates, d)
+			continue outer
+		}
+	}
 }
 
-func ClearCache(config *Config, client *cups.Client) error {
+func ClearCache(ctx context.Context, config *Config, client *cups.Client, store cache.Store) error {
 	log.Println("INFO: Clearing cached printers")
 	// cache api printer ids
-	pCache, err := cache.Read(config.CachePath)
+	pCache, err := store.Read()
 	if err != nil {
 		return fmt.Errorf("Unable to read cache: %w", err)
 	}
@@ -189,6 +546,7 @@ func ClearCache(config *Config, client *cups.Client) error {
 	cupsPrinters, err := client.GetPrinters()
 	if err != nil {
 		if !strings.Contains(err.Error(), "No destinations added.") {
+			events.Publish(ctx, events.CUPSUnreachable, "", "%v", err)
 			return fmt.Errorf("Unable to get CUPS printers: %w", err)
 		}
 	}
@@ -196,16 +554,33 @@ func ClearCache(config *Config, client *cups.Client) error {
 	log.Println("INFO: Got", len(cupsPrinters), "printers from CUPS")
 
 	// delete expired printers
-	var deleted []string
+	var deleted, deferred []string
 outerExpired:
-	for id := range pCache {
+	for id := range pCache.Printers {
+		if ctx.Err() != nil {
+			break
+		}
+
 		for _, cp := range cupsPrinters {
 			if id == cp.ID {
-				if err = client.Delete(cp); err != nil {
+				if config.IsProtected(cp) {
+					log.Printf("INFO: Skipped deleting protected printer %s (%s)\n", cp.ID, cp.Hostname)
+					break
+				}
+				isDeferred, err := deletePrinter(ctx, config, client, cp)
+				if err != nil {
 					log.Printf("WARN: Unable to delete expired printer %s (%s): %v\n", cp.ID, cp.Hostname, err)
 					continue outerExpired
 				}
+				if isDeferred {
+					log.Printf("INFO: Deferred deleting printer %s (%s) with active jobs\n", cp.ID, cp.Hostname)
+					progress.Report(ctx, "Deferred deleting printer %s with active jobs", cp.ID)
+					deferred = append(deferred, id)
+					continue outerExpired
+				}
 				log.Printf("INFO: Deleted expired printer %s (%s)\n", cp.ID, cp.Hostname)
+				progress.Report(ctx, "Deleted printer %s", cp.ID)
+				events.Publish(ctx, events.PrinterRemoved, cp.ID, "cache cleared")
 				break
 			}
 		}
@@ -213,11 +588,60 @@ outerExpired:
 		deleted = append(deleted, id)
 	}
 
-	// purge expired printers from cache
-	if err = cache.Purge(config.CachePath, deleted); err != nil {
+	// purge deleted printers from cache and expire deferred printers so the next sync deletes them
+	if err = store.Update(func(c *cache.Cache) error {
+		for _, id := range deleted {
+			delete(c.Printers, id)
+		}
+		now := time.Now()
+		for _, id := range deferred {
+			if e, ok := c.Printers[id]; ok {
+				e.Expiration = now
+			}
+		}
+		return nil
+	}); err != nil {
 		log.Println("WARN: Unable to purge cache:", err)
 	}
 
+	if err = ctx.Err(); err != nil {
+		return fmt.Errorf("Clearing cache canceled: %w", err)
+	}
+
 	log.Println("INFO: Cache cleared successfully")
 	return nil
 }
+
+// purge removes the given printer ids from the cache
+func purge(store cache.Store, ids []string) error {
+	return store.Update(func(c *cache.Cache) error {
+		for _, id := range ids {
+			delete(c.Printers, id)
+		}
+		return nil
+	})
+}
+
+// deletePrinter deletes the CUPS printer, waiting for active jobs according to config.ActiveJobPolicy.
+// deferred is true if the printer wasn't deleted because it still has active jobs
+func deletePrinter(ctx context.Context, config *Config, client *cups.Client, p *cups.Printer) (deferred bool, err error) {
+	n, err := client.ActiveJobs(p)
+	if err != nil {
+		return false, fmt.Errorf("Unable to get active jobs: %w", err)
+	}
+
+	if n > 0 {
+		if config.ActiveJobPolicy == ActiveJobPolicyDefer {
+			return true, nil
+		}
+		log.Printf("INFO: Draining printer %s (%s) with %d active jobs\n", p.ID, p.Hostname, n)
+		if err = client.Drain(ctx, p, config.DrainTimeout); err != nil {
+			if errors.Is(err, cups.ErrActiveJobs) {
+				return true, nil
+			}
+			return false, fmt.Errorf("Unable to drain printer: %w", err)
+		}
+	}
+
+	return false, client.Delete(p)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/korylprince/printer-manager-cups/cache"
+	"github.com/korylprince/printer-manager-cups/cups"
+)
+
+func TestHandleDuplicatesSkipsCachedPrinters(t *testing.T) {
+	const uri = "ipp://printer1.example.com/ipp/print"
+	printers := []*cups.Printer{{
+		ID:       "printer1",
+		Hostname: "printer1.example.com",
+		Driver:   &cups.Driver{CUPS: &cups.CUPS{URITemplate: "ipp://%s/ipp/print"}},
+	}}
+
+	// printer2 was installed for another user, so it's cached but not in this API response
+	pCache := cache.New()
+	pCache.Entry("printer1")
+	pCache.Entry("printer2")
+
+	cupsPrinters := []*cups.Printer{
+		{ID: "printer1", Hostname: uri},
+		{ID: "printer2", Hostname: uri},
+		{ID: "local", Hostname: uri},
+		{ID: "other", Hostname: "ipp://printer2.example.com/ipp/print"},
+	}
+
+	report := new(SyncReport)
+	config := &Config{DuplicatePolicy: DuplicatePolicyReport}
+	handleDuplicates(context.Background(), config, nil, report, printers, cupsPrinters, make(map[string]*cups.Printer), pCache)
+
+	if len(report.Duplicates) != 1 {
+		t.Fatalf("expected 1 duplicate, got %d: %v", len(report.Duplicates), report.Duplicates)
+	}
+	if d := report.Duplicates[0]; d.ID != "local" || d.MatchedID != "printer1" || d.Action != DuplicateReported {
+		t.Errorf("expected local to be reported as a duplicate of printer1, got %s %s of %s", d.ID, d.Action, d.MatchedID)
+	}
+}
@@ -0,0 +1,85 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+//listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+//Notify sends state to the systemd notification socket. If the process wasn't started by systemd with
+//NotifyAccess set, false is returned. An error is returned if one occurred
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("Unable to dial %s: %w", path, err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("Unable to write state: %w", err)
+	}
+
+	return true, nil
+}
+
+//WatchdogInterval returns the interval systemd expects WATCHDOG=1 notifications within, or 0 if the watchdog isn't enabled
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid WATCHDOG_USEC: %s", usec)
+	}
+
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+//Listeners returns the listeners passed by socket activation, or nil if the process wasn't socket activated
+func Listeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("Invalid LISTEN_FDS")
+	}
+
+	// don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create listener for fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}